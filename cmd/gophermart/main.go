@@ -1,18 +1,57 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+
 	app "github.com/rutkin/gofermart/internal"
 	"github.com/rutkin/gofermart/internal/config"
+	"github.com/rutkin/gofermart/internal/helpers"
 	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/tracing"
 )
 
 func main() {
-	config := config.MakeConfig()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reconcile":
+			os.Exit(runReconcile(os.Args[2:]))
+		case "set-role":
+			os.Exit(runSetRole(os.Args[2:]))
+		}
+	}
+
+	config, err := config.MakeConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// the config is printed before validation so it helps to find out why it is invalid
+	if config.PrintConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			panic(err)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	if config.PrintConfig {
+		return
+	}
+	helpers.SetSecret(config.CookieSecret)
+
+	err = logger.Initialize(config.LogLevel)
+	if err != nil {
+		panic(err)
+	}
 
-	err := logger.Initialize(config.LogLevel)
+	shutdownTracing, err := tracing.Initialize(config.TraceExporter, config.TraceFile, config.TraceEndpoint)
 	if err != nil {
 		panic(err)
 	}
+	defer shutdownTracing(context.Background())
 
 	server, err := app.MakeServer(config)
 	if err != nil {
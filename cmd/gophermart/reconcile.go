@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rutkin/gofermart/internal/config"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/repository"
+)
+
+func runReconcile(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "repair discrepancies")
+	config, err := config.ParseConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if config.DatabaseURI == "" {
+		fmt.Fprintln(os.Stderr, "database uri (-d, DATABASE_URI) is required")
+		return 2
+	}
+
+	if err := logger.Initialize(config.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	db, err := repository.NewDatabase(config.DatabaseURI)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	discrepancies, err := db.Reconcile(context.Background(), *fix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	unfixed := 0
+	for _, item := range discrepancies {
+		fmt.Printf("%s current=%.2f expected=%.2f withdrawn=%.2f expected=%.2f fixed=%t\n",
+			item.UserID, item.Current, item.ExpectedCurrent, item.Withdrawn, item.ExpectedWithdrawn, item.Fixed)
+		if !item.Fixed {
+			unfixed++
+		}
+	}
+	fmt.Printf("discrepancies: %d, unfixed: %d\n", len(discrepancies), unfixed)
+
+	if unfixed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rutkin/gofermart/internal/config"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/repository"
+)
+
+func runSetRole(args []string) int {
+	fs := flag.NewFlagSet("set-role", flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	role := fs.String("role", models.RoleAdmin, "role: user or admin")
+	config, err := config.ParseConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if config.DatabaseURI == "" || *login == "" {
+		fmt.Fprintln(os.Stderr, "database uri (-d, DATABASE_URI) and -login are required")
+		return 2
+	}
+	if *role != models.RoleUser && *role != models.RoleAdmin {
+		fmt.Fprintf(os.Stderr, "unknown role %q\n", *role)
+		return 2
+	}
+
+	if err := logger.Initialize(config.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	db, err := repository.NewDatabase(config.DatabaseURI)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := db.SetUserRole(context.Background(), "cli", *login, *role); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: %s\n", *login, *role)
+	return 0
+}
@@ -1,35 +1,327 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+const redacted = "[REDACTED]"
+
 type Config struct {
-	LogLevel             string
-	RunAddress           string
-	DatabaseURI          string
-	AccrualSystemAddress string
+	ConfigFile  string `yaml:"-"`
+	PrintConfig bool   `yaml:"-"`
+
+	name string
+	args []string
+
+	LogLevel              string `yaml:"log_level"`
+	RunAddress            string `yaml:"run_address"`
+	AdminAddress          string `yaml:"admin_address"`
+	AdminToken            string `yaml:"admin_token"`
+	DatabaseURI           string `yaml:"database_uri"`
+	AccrualSystemAddress  string `yaml:"accrual_system_address"`
+	AccrualCallbackSecret string `yaml:"accrual_callback_secret"`
+	CookieSecret          string `yaml:"cookie_secret"`
+
+	CookieSecure       bool          `yaml:"cookie_secure"`
+	CookieSameSite     string        `yaml:"cookie_same_site"`
+	CookieDomain       string        `yaml:"cookie_domain"`
+	CookieMaxAge       time.Duration `yaml:"cookie_max_age"`
+	CSRFTrustedOrigins string        `yaml:"csrf_trusted_origins"`
+
+	TLSCertFile      string `yaml:"tls_cert_file"`
+	TLSKeyFile       string `yaml:"tls_key_file"`
+	MaxBodySize      int64  `yaml:"max_body_size"`
+	MaxBatchBodySize int64  `yaml:"max_batch_body_size"`
+
+	CompressionMinSize      int   `yaml:"compression_min_size"`
+	MaxDecompressedBodySize int64 `yaml:"max_decompressed_body_size"`
+
+	RateLimitStore  string `yaml:"rate_limit_store"`
+	RateLimitAuth   string `yaml:"rate_limit_auth"`
+	RateLimitOrders string `yaml:"rate_limit_orders"`
+	RateLimitAPI    string `yaml:"rate_limit_api"`
+	TrustedProxies  string `yaml:"trusted_proxies"`
+
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+
+	OrdersWorkers     int           `yaml:"orders_workers"`
+	OrdersQueueSize   int           `yaml:"orders_queue_size"`
+	SweepInterval     time.Duration `yaml:"sweep_interval"`
+	StuckOrderAge     time.Duration `yaml:"stuck_order_age"`
+	OrderMaxAttempts  int           `yaml:"order_max_attempts"`
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+
+	HoldTTL            time.Duration `yaml:"hold_ttl"`
+	HoldMaxTTL         time.Duration `yaml:"hold_max_ttl"`
+	HoldExpireInterval time.Duration `yaml:"hold_expire_interval"`
+
+	PointsPendingPeriod  time.Duration `yaml:"points_pending_period"`
+	PointsTTL            time.Duration `yaml:"points_ttl"`
+	PointsExpiryNotice   time.Duration `yaml:"points_expiry_notice"`
+	PointsExpiryInterval time.Duration `yaml:"points_expiry_interval"`
+
+	TransferDailyAmount int `yaml:"transfer_daily_amount"`
+	TransferDailyCount  int `yaml:"transfer_daily_count"`
+
+	TraceExporter string `yaml:"trace_exporter"`
+	TraceFile     string `yaml:"trace_file"`
+	TraceEndpoint string `yaml:"trace_endpoint"`
+
+	ReadinessQueueThreshold int           `yaml:"readiness_queue_threshold"`
+	ShutdownDelay           time.Duration `yaml:"shutdown_delay"`
+	ShutdownTimeout         time.Duration `yaml:"shutdown_timeout"`
+}
+
+type option struct {
+	flag   string
+	env    string
+	usage  string
+	value  any
+	secret bool
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		LogLevel:                "info",
+		CookieSameSite:          "lax",
+		CookieMaxAge:            30 * 24 * time.Hour,
+		MaxBodySize:             1 << 20,
+		MaxBatchBodySize:        4 << 20,
+		CompressionMinSize:      1024,
+		MaxDecompressedBodySize: 16 << 20,
+		RateLimitStore:          "memory",
+		RateLimitAuth:           "10/m",
+		RateLimitOrders:         "60/m",
+		RateLimitAPI:            "600/m",
+		ReadTimeout:             10 * time.Second,
+		ReadHeaderTimeout:       5 * time.Second,
+		WriteTimeout:            30 * time.Second,
+		IdleTimeout:             2 * time.Minute,
+		OrdersWorkers:           4,
+		OrdersQueueSize:         1000,
+		SweepInterval:           time.Minute,
+		StuckOrderAge:           2 * time.Minute,
+		OrderMaxAttempts:        10,
+		HoldTTL:                 15 * time.Minute,
+		HoldMaxTTL:              24 * time.Hour,
+		HoldExpireInterval:      time.Minute,
+		PointsExpiryNotice:      30 * 24 * time.Hour,
+		PointsExpiryInterval:    time.Hour,
+		TransferDailyAmount:     1000,
+		TransferDailyCount:      20,
+		TraceExporter:           "none",
+		TraceFile:               "traces.json",
+		ReadinessQueueThreshold: 900,
+		ShutdownTimeout:         10 * time.Second,
+	}
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"c", "CONFIG", "config file in yaml or json format", &c.ConfigFile, false},
+		{"print-config", "", "print effective config and exit", &c.PrintConfig, false},
+		{"log-level", "LOG_LEVEL", "log level", &c.LogLevel, false},
+		{"a", "RUN_ADDRESS", "run address", &c.RunAddress, false},
+		{"admin-address", "ADMIN_ADDRESS", "admin listener address for metrics, empty disables", &c.AdminAddress, false},
+		{"admin-token", "ADMIN_TOKEN", "bearer token for admin endpoints, empty disables them", &c.AdminToken, true},
+		{"d", "DATABASE_URI", "database uri", &c.DatabaseURI, false},
+		{"r", "ACCRUAL_SYSTEM_ADDRESS", "accrual system address", &c.AccrualSystemAddress, false},
+		{"s", "ACCRUAL_CALLBACK_SECRET", "accrual callback secret", &c.AccrualCallbackSecret, true},
+		{"cookie-secret", "COOKIE_SECRET", "auth cookie encryption secret", &c.CookieSecret, true},
+		{"cookie-secure", "COOKIE_SECURE", "send auth cookie over https only", &c.CookieSecure, false},
+		{"cookie-same-site", "COOKIE_SAME_SITE", "auth cookie SameSite attribute: lax, strict or none", &c.CookieSameSite, false},
+		{"cookie-domain", "COOKIE_DOMAIN", "auth cookie domain", &c.CookieDomain, false},
+		{"cookie-max-age", "COOKIE_MAX_AGE", "auth cookie and token lifetime", &c.CookieMaxAge, false},
+		{"csrf-trusted-origins", "CSRF_TRUSTED_ORIGINS", "comma separated origins allowed to send cookie authenticated requests", &c.CSRFTrustedOrigins, false},
+		{"tls-cert-file", "TLS_CERT_FILE", "tls certificate file, enables https together with tls-key-file", &c.TLSCertFile, false},
+		{"tls-key-file", "TLS_KEY_FILE", "tls private key file", &c.TLSKeyFile, false},
+		{"max-body-size", "MAX_BODY_SIZE", "maximum request body size in bytes", &c.MaxBodySize, false},
+		{"max-batch-body-size", "MAX_BATCH_BODY_SIZE", "maximum batch orders request body size in bytes", &c.MaxBatchBodySize, false},
+		{"compression-min-size", "COMPRESSION_MIN_SIZE", "minimum response size in bytes to compress", &c.CompressionMinSize, false},
+		{"max-decompressed-body-size", "MAX_DECOMPRESSED_BODY_SIZE", "maximum decompressed request body size in bytes", &c.MaxDecompressedBodySize, false},
+		{"rate-limit-store", "RATE_LIMIT_STORE", "rate limit store: memory or postgres", &c.RateLimitStore, false},
+		{"rate-limit-auth", "RATE_LIMIT_AUTH", "register and login rate limit per client ip, like 10/m, 0 disables", &c.RateLimitAuth, false},
+		{"rate-limit-orders", "RATE_LIMIT_ORDERS", "orders upload rate limit per user, 0 disables", &c.RateLimitOrders, false},
+		{"rate-limit-api", "RATE_LIMIT_API", "rate limit per user for other authenticated routes, 0 disables", &c.RateLimitAPI, false},
+		{"trusted-proxies", "TRUSTED_PROXIES", "comma separated proxy addresses or cidrs trusted to set X-Forwarded-For", &c.TrustedProxies, false},
+		{"read-timeout", "READ_TIMEOUT", "http read timeout", &c.ReadTimeout, false},
+		{"read-header-timeout", "READ_HEADER_TIMEOUT", "http read header timeout", &c.ReadHeaderTimeout, false},
+		{"write-timeout", "WRITE_TIMEOUT", "http write timeout", &c.WriteTimeout, false},
+		{"idle-timeout", "IDLE_TIMEOUT", "http idle timeout", &c.IdleTimeout, false},
+		{"orders-workers", "ORDERS_WORKERS", "number of accrual polling workers", &c.OrdersWorkers, false},
+		{"orders-queue-size", "ORDERS_QUEUE_SIZE", "accrual polling queue size", &c.OrdersQueueSize, false},
+		{"sweep-interval", "SWEEP_INTERVAL", "stuck orders sweep interval", &c.SweepInterval, false},
+		{"stuck-order-age", "STUCK_ORDER_AGE", "age after which unprocessed order is considered stuck", &c.StuckOrderAge, false},
+		{"order-max-attempts", "ORDER_MAX_ATTEMPTS", "number of sweeps before stuck order is marked invalid", &c.OrderMaxAttempts, false},
+		{"reconcile-interval", "RECONCILE_INTERVAL", "balance reconciliation check interval, 0 disables", &c.ReconcileInterval, false},
+		{"hold-ttl", "HOLD_TTL", "default lifetime of a balance hold", &c.HoldTTL, false},
+		{"hold-max-ttl", "HOLD_MAX_TTL", "maximum lifetime of a balance hold a client may request", &c.HoldMaxTTL, false},
+		{"hold-expire-interval", "HOLD_EXPIRE_INTERVAL", "interval of marking expired balance holds, 0 disables", &c.HoldExpireInterval, false},
+		{"points-pending-period", "POINTS_PENDING_PERIOD", "cooling-off period before accrued points can be spent, like 336h, 0 disables", &c.PointsPendingPeriod, false},
+		{"points-ttl", "POINTS_TTL", "lifetime of credited points, like 8760h, 0 keeps points forever", &c.PointsTTL, false},
+		{"points-expiry-notice", "POINTS_EXPIRY_NOTICE", "how far ahead balance reports expiring points, 0 disables", &c.PointsExpiryNotice, false},
+		{"points-expiry-interval", "POINTS_EXPIRY_INTERVAL", "interval of writing off expired points, 0 disables", &c.PointsExpiryInterval, false},
+		{"transfer-daily-amount", "TRANSFER_DAILY_AMOUNT", "points a user may transfer per day, 0 disables", &c.TransferDailyAmount, false},
+		{"transfer-daily-count", "TRANSFER_DAILY_COUNT", "transfers a user may send per day, 0 disables", &c.TransferDailyCount, false},
+		{"trace-exporter", "TRACE_EXPORTER", "trace exporter: none, stdout, file or otlp", &c.TraceExporter, false},
+		{"trace-file", "TRACE_FILE", "trace file for file exporter", &c.TraceFile, false},
+		{"trace-endpoint", "TRACE_ENDPOINT", "otlp http endpoint url", &c.TraceEndpoint, false},
+		{"readiness-queue-threshold", "READINESS_QUEUE_THRESHOLD", "orders queue depth at which service reports not ready", &c.ReadinessQueueThreshold, false},
+		{"shutdown-delay", "SHUTDOWN_DELAY", "delay between reporting not ready and stopping the server", &c.ShutdownDelay, false},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "graceful shutdown timeout", &c.ShutdownTimeout, false},
+	}
+}
+
+func bindFlags(fs *flag.FlagSet, options []option) {
+	for _, o := range options {
+		switch v := o.value.(type) {
+		case *string:
+			fs.StringVar(v, o.flag, *v, o.usage)
+		case *int:
+			fs.IntVar(v, o.flag, *v, o.usage)
+		case *int64:
+			fs.Int64Var(v, o.flag, *v, o.usage)
+		case *bool:
+			fs.BoolVar(v, o.flag, *v, o.usage)
+		case *time.Duration:
+			fs.DurationVar(v, o.flag, *v, o.usage)
+		}
+	}
 }
 
-func MakeConfig() *Config {
-	config := &Config{LogLevel: "info"}
-	flag.StringVar(&config.RunAddress, "a", "", "run address")
-	flag.StringVar(&config.DatabaseURI, "d", "", "database uri")
-	flag.StringVar(&config.AccrualSystemAddress, "r", "", "accrual system address")
-	flag.Parse()
+func applyEnv(options []option) error {
+	for _, o := range options {
+		if o.env == "" {
+			continue
+		}
+		env, ok := os.LookupEnv(o.env)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch v := o.value.(type) {
+		case *string:
+			*v = env
+		case *int:
+			*v, err = strconv.Atoi(env)
+		case *int64:
+			*v, err = strconv.ParseInt(env, 10, 64)
+		case *bool:
+			*v, err = strconv.ParseBool(env)
+		case *time.Duration:
+			*v, err = time.ParseDuration(env)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", o.env, err)
+		}
+	}
+	return nil
+}
 
-	if runAddress, ok := os.LookupEnv("RUN_ADDRESS"); ok {
-		config.RunAddress = runAddress
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	if databaseURI, ok := os.LookupEnv("DATABASE_URI"); ok {
-		config.DatabaseURI = databaseURI
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
 	}
+	return nil
+}
+
+func MakeConfig() (*Config, error) {
+	return ParseConfig(flag.CommandLine, os.Args[1:])
+}
+
+func ParseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	parsed := defaultConfig()
+	bindFlags(fs, parsed.options())
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := defaultConfig()
+	config.ConfigFile = os.Getenv("CONFIG")
+	if parsed.ConfigFile != "" {
+		config.ConfigFile = parsed.ConfigFile
+	}
+	if config.ConfigFile != "" {
+		if err := config.loadFile(config.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(config.options()); err != nil {
+		return nil, err
+	}
+
+	final := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	bindFlags(final, config.options())
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if final.Lookup(f.Name) == nil || err != nil {
+			return
+		}
+		err = final.Set(f.Name, f.Value.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config.name = fs.Name()
+	config.args = args
+	return config, nil
+}
+
+// Reload parses the config again from the original command line, config file and env.
+func (c *Config) Reload() (*Config, error) {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	config, err := ParseConfig(fs, c.args)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	return u.Redacted()
+}
 
-	if accrualSystemAddress, ok := os.LookupEnv("ACCRUAL_SYSTEM_ADDRESS"); ok {
-		config.AccrualSystemAddress = accrualSystemAddress
+func (c *Config) Print(w io.Writer) error {
+	redactedConfig := *c
+	for _, o := range redactedConfig.options() {
+		if v, ok := o.value.(*string); ok && o.secret && *v != "" {
+			*v = redacted
+		}
 	}
+	redactedConfig.DatabaseURI = redactURI(redactedConfig.DatabaseURI)
 
-	return config
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+	return enc.Encode(redactedConfig)
 }
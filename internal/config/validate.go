@@ -0,0 +1,129 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/ratelimit"
+	"go.uber.org/zap/zapcore"
+)
+
+var traceExporters = map[string]bool{"none": true, "stdout": true, "file": true, "otlp": true}
+
+func (c *Config) Validate() error {
+	var errs []error
+	required := func(name string, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	positive := func(name string, value int) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %d", name, value))
+		}
+	}
+	nonNegative := func(name string, value time.Duration) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", name, value))
+		}
+	}
+
+	required("run address (-a, RUN_ADDRESS)", c.RunAddress)
+	required("database uri (-d, DATABASE_URI)", c.DatabaseURI)
+	required("accrual system address (-r, ACCRUAL_SYSTEM_ADDRESS)", c.AccrualSystemAddress)
+	required("cookie secret (-cookie-secret, COOKIE_SECRET)", c.CookieSecret)
+
+	switch c.CookieSameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.CookieSecure {
+			errs = append(errs, errors.New("cookie same site none requires cookie secure"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid cookie same site %q, expected lax, strict or none", c.CookieSameSite))
+	}
+	if c.CookieMaxAge <= 0 {
+		errs = append(errs, fmt.Errorf("cookie max age must be positive, got %s", c.CookieMaxAge))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls cert file and tls key file must be set together"))
+	}
+	if c.MaxBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("max body size must be positive, got %d", c.MaxBodySize))
+	}
+	if c.MaxBatchBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("max batch body size must be positive, got %d", c.MaxBatchBodySize))
+	}
+
+	if c.CompressionMinSize < 0 {
+		errs = append(errs, fmt.Errorf("compression min size must not be negative, got %d", c.CompressionMinSize))
+	}
+	if c.MaxDecompressedBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("max decompressed body size must be positive, got %d", c.MaxDecompressedBodySize))
+	}
+
+	if c.RateLimitStore != "memory" && c.RateLimitStore != "postgres" {
+		errs = append(errs, fmt.Errorf("unknown rate limit store %q", c.RateLimitStore))
+	}
+	for _, limit := range []struct{ name, value string }{
+		{"auth", c.RateLimitAuth},
+		{"orders", c.RateLimitOrders},
+		{"api", c.RateLimitAPI},
+	} {
+		if _, err := ratelimit.ParseLimit(limit.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s rate limit: %w", limit.name, err))
+		}
+	}
+	if _, err := ratelimit.NewClientIP(c.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log level %q", c.LogLevel))
+	}
+
+	nonNegative("read timeout", c.ReadTimeout)
+	nonNegative("read header timeout", c.ReadHeaderTimeout)
+	nonNegative("write timeout", c.WriteTimeout)
+	nonNegative("idle timeout", c.IdleTimeout)
+	nonNegative("sweep interval", c.SweepInterval)
+	nonNegative("reconcile interval", c.ReconcileInterval)
+	nonNegative("hold expire interval", c.HoldExpireInterval)
+	nonNegative("points pending period", c.PointsPendingPeriod)
+	if c.PointsTTL > 0 && c.PointsPendingPeriod >= c.PointsTTL {
+		errs = append(errs, fmt.Errorf("points pending period %s must be shorter than points ttl %s", c.PointsPendingPeriod, c.PointsTTL))
+	}
+	nonNegative("points ttl", c.PointsTTL)
+	nonNegative("points expiry notice", c.PointsExpiryNotice)
+	nonNegative("points expiry interval", c.PointsExpiryInterval)
+	nonNegative("shutdown delay", c.ShutdownDelay)
+	nonNegative("shutdown timeout", c.ShutdownTimeout)
+	if c.AccrualCallbackSecret != "" && c.SweepInterval <= 0 {
+		errs = append(errs, errors.New("sweep interval must be positive when the accrual callback is enabled"))
+	}
+	if c.StuckOrderAge <= 0 {
+		errs = append(errs, fmt.Errorf("stuck order age must be positive, got %s", c.StuckOrderAge))
+	}
+	if c.TransferDailyAmount < 0 || c.TransferDailyCount < 0 {
+		errs = append(errs, fmt.Errorf("transfer daily limits must not be negative, got amount %d and count %d", c.TransferDailyAmount, c.TransferDailyCount))
+	}
+	if c.HoldTTL <= 0 || c.HoldTTL > c.HoldMaxTTL {
+		errs = append(errs, fmt.Errorf("hold ttl must be positive and not exceed hold max ttl %s, got %s", c.HoldMaxTTL, c.HoldTTL))
+	}
+
+	positive("orders workers", c.OrdersWorkers)
+	positive("orders queue size", c.OrdersQueueSize)
+	positive("order max attempts", c.OrderMaxAttempts)
+	positive("readiness queue threshold", c.ReadinessQueueThreshold)
+
+	if !traceExporters[c.TraceExporter] {
+		errs = append(errs, fmt.Errorf("unknown trace exporter %q", c.TraceExporter))
+	}
+	if c.TraceExporter == "file" && c.TraceFile == "" {
+		errs = append(errs, errors.New("trace file is required for file exporter"))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func validConfig() *Config {
+	config := defaultConfig()
+	config.RunAddress = ":8080"
+	config.DatabaseURI = "postgres://localhost/db"
+	config.AccrualSystemAddress = "http://localhost:8081"
+	config.CookieSecret = "secret"
+	return config
+}
+
+func TestValidateAcceptsDefaults(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"no run address", func(c *Config) { c.RunAddress = "" }},
+		{"no database uri", func(c *Config) { c.DatabaseURI = "" }},
+		{"no accrual address", func(c *Config) { c.AccrualSystemAddress = "" }},
+		{"no cookie secret", func(c *Config) { c.CookieSecret = "" }},
+		{"same site none without secure", func(c *Config) { c.CookieSameSite = "none" }},
+		{"unknown same site", func(c *Config) { c.CookieSameSite = "loose" }},
+		{"zero cookie max age", func(c *Config) { c.CookieMaxAge = 0 }},
+		{"tls cert without key", func(c *Config) { c.TLSCertFile = "cert.pem" }},
+		{"zero body size", func(c *Config) { c.MaxBodySize = 0 }},
+		{"bad rate limit", func(c *Config) { c.RateLimitAPI = "10/d" }},
+		{"bad trusted proxy", func(c *Config) { c.TrustedProxies = "proxy.local" }},
+		{"bad log level", func(c *Config) { c.LogLevel = "loud" }},
+		{"negative read timeout", func(c *Config) { c.ReadTimeout = -time.Second }},
+		{"zero stuck order age", func(c *Config) { c.StuckOrderAge = 0 }},
+		{"callback without sweeper", func(c *Config) { c.AccrualCallbackSecret = "secret"; c.SweepInterval = 0 }},
+		{"pending period not shorter than ttl", func(c *Config) { c.PointsTTL = time.Hour; c.PointsPendingPeriod = time.Hour }},
+		{"hold ttl above max", func(c *Config) { c.HoldTTL = 2 * c.HoldMaxTTL }},
+		{"negative transfer limit", func(c *Config) { c.TransferDailyAmount = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			tt.modify(config)
+			if err := config.Validate(); err == nil {
+				t.Fatal("Validate() accepted invalid config")
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsOptionalFeatures(t *testing.T) {
+	config := validConfig()
+	config.CookieSameSite = "none"
+	config.CookieSecure = true
+	config.AccrualCallbackSecret = "secret"
+	config.PointsTTL = 24 * time.Hour
+	config.PointsPendingPeriod = time.Hour
+	config.TLSCertFile = "cert.pem"
+	config.TLSKeyFile = "key.pem"
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+}
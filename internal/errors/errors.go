@@ -9,3 +9,7 @@ var ErrInternal = errors.New("internal error")
 var ErrTimeout = errors.New("timeout")
 var ErrInvalid = errors.New("invalid")
 var ErrNotEnoughtMoney = errors.New("not enought money")
+var ErrDebt = errors.New("balance is in debt")
+var ErrTooManyRequests = errors.New("too many requests")
+var ErrUnavailable = errors.New("unavailable")
+var ErrLimitExceeded = errors.New("limit exceeded")
@@ -0,0 +1,142 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	OrderEvent   = "order"
+	BalanceEvent = "balance"
+)
+
+const subscriberBufferSize = 16
+
+type Event struct {
+	ID     uint64
+	UserID string
+	Type   string
+	Data   []byte
+}
+
+func NewBroker(logSize int) *Broker {
+	return &Broker{
+		logSize:     logSize,
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+}
+
+type Broker struct {
+	mu          sync.Mutex
+	lastID      uint64
+	log         []Event
+	logSize     int
+	subscribers map[string]map[chan Event]struct{}
+}
+
+// NewEvent builds an event with the payload encoded as json.
+func NewEvent(id uint64, userID string, eventType string, payload any) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Log.Error("failed to marshal event", zap.String("error", err.Error()))
+		return Event{}, err
+	}
+	return Event{ID: id, UserID: userID, Type: eventType, Data: data}, nil
+}
+
+func (b *Broker) Publish(userID string, eventType string, payload any) {
+	event, err := NewEvent(0, userID, eventType, payload)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event.ID = b.lastID
+	if len(b.log) == b.logSize {
+		copy(b.log, b.log[1:])
+		b.log = b.log[:len(b.log)-1]
+	}
+	b.log = append(b.log, event)
+
+	for ch := range b.subscribers[userID] {
+		select {
+		case ch <- event:
+		default:
+			logger.Log.Info("drop slow events subscriber", zap.String("userID", userID))
+			b.unsubscribe(userID, ch)
+		}
+	}
+}
+
+type Subscription struct {
+	Backlog []Event
+	Events  <-chan Event
+	Cancel  func()
+	// Resync is set when events after the requested id can't be replayed, either since the id comes
+	// from before a restart or the log no longer has them. The subscriber should be sent the current
+	// state instead, stamped with LastID.
+	Resync bool
+	LastID uint64
+}
+
+func (b *Broker) Subscribe(userID string, lastEventID uint64) Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := Subscription{LastID: b.lastID}
+	if lastEventID > 0 {
+		sub.Resync = lastEventID > b.lastID || (len(b.log) > 0 && b.log[0].ID > lastEventID+1)
+	}
+	if lastEventID > 0 && !sub.Resync {
+		for _, event := range b.log {
+			if event.UserID == userID && event.ID > lastEventID {
+				sub.Backlog = append(sub.Backlog, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, subscriberBufferSize)
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+
+	sub.Events = ch
+	sub.Cancel = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.unsubscribe(userID, ch)
+	}
+	return sub
+}
+
+func (b *Broker) unsubscribe(userID string, ch chan Event) {
+	subscribers, ok := b.subscribers[userID]
+	if !ok {
+		return
+	}
+	if _, ok := subscribers[ch]; !ok {
+		return
+	}
+	delete(subscribers, ch)
+	close(ch)
+	if len(subscribers) == 0 {
+		delete(b.subscribers, userID)
+	}
+}
+
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for userID, subscribers := range b.subscribers {
+		for ch := range subscribers {
+			b.unsubscribe(userID, ch)
+		}
+	}
+}
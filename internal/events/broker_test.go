@@ -0,0 +1,73 @@
+package events
+
+import "testing"
+
+func publishN(b *Broker, userID string, n int) {
+	for i := 0; i < n; i++ {
+		b.Publish(userID, OrderEvent, map[string]int{"n": i})
+	}
+}
+
+func TestSubscribeReplaysBacklog(t *testing.T) {
+	b := NewBroker(10)
+	publishN(b, "user", 3)
+	publishN(b, "other", 1)
+
+	sub := b.Subscribe("user", 1)
+	defer sub.Cancel()
+
+	if sub.Resync {
+		t.Fatal("known event id asks for resync")
+	}
+	if len(sub.Backlog) != 2 || sub.Backlog[0].ID != 2 || sub.Backlog[1].ID != 3 {
+		t.Fatalf("backlog = %+v, want events 2 and 3 of the user", sub.Backlog)
+	}
+	if sub.LastID != 4 {
+		t.Fatalf("last id = %d, want 4", sub.LastID)
+	}
+}
+
+func TestSubscribeResync(t *testing.T) {
+	tests := []struct {
+		name        string
+		logSize     int
+		published   int
+		lastEventID uint64
+		resync      bool
+	}{
+		{"fresh subscriber", 10, 3, 0, false},
+		{"up to date", 10, 3, 3, false},
+		{"id from before restart", 10, 3, 42, true},
+		{"id before empty log after restart", 10, 0, 5, true},
+		{"missed events evicted", 2, 5, 1, true},
+		{"oldest kept event is next", 2, 5, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBroker(tt.logSize)
+			publishN(b, "user", tt.published)
+
+			sub := b.Subscribe("user", tt.lastEventID)
+			defer sub.Cancel()
+
+			if sub.Resync != tt.resync {
+				t.Fatalf("resync = %v, want %v", sub.Resync, tt.resync)
+			}
+			if sub.Resync && len(sub.Backlog) != 0 {
+				t.Fatalf("backlog = %+v, want none on resync", sub.Backlog)
+			}
+		})
+	}
+}
+
+func TestPublishDeliversToSubscribers(t *testing.T) {
+	b := NewBroker(10)
+	sub := b.Subscribe("user", 0)
+	defer sub.Cancel()
+
+	b.Publish("user", BalanceEvent, map[string]float64{"current": 10})
+	event := <-sub.Events
+	if event.ID != 1 || event.Type != BalanceEvent || string(event.Data) != `{"current":10}` {
+		t.Fatalf("event = %+v", event)
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	accrualTimestampHeader = "X-Accrual-Timestamp"
+	accrualSignatureHeader = "X-Accrual-Signature"
+)
+
+func (h *Handler) AccrualCallback(w http.ResponseWriter, r *http.Request) {
+	if !h.service.AccrualCallbackEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to read accrual callback body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if !h.service.VerifyAccrualSignature(body, r.Header.Get(accrualTimestampHeader), r.Header.Get(accrualSignatureHeader)) {
+		logger.FromContext(r.Context()).Error("invalid accrual callback signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req models.LoyaltyOrderRecord
+	if err := decodeJSON(bytes.NewReader(body), &req); err != nil || req.Number == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.ApplyAccrualCallback(r.Context(), req)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, myerrors.ErrInvalid):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, myerrors.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		logger.FromContext(r.Context()).Error("failed to apply accrual callback", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/middleware"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+func (h *Handler) Roles() middleware.Roles {
+	return h.service
+}
+
+func queryInt(r *http.Request, name string, def int, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > max {
+		return 0, myerrors.ErrInvalid
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+	}
+}
+
+func (h *Handler) AdminSearchUsers(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultAdminPageSize, maxAdminPageSize)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(r, "offset", 0, 1<<30)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.service.SearchUsers(r.Context(), getUserID(r.Context()), r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to search users", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) AdminGetUserOrders(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.service.GetUserOrders(r.Context(), getUserID(r.Context()), chi.URLParam(r, "userID"))
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get user orders", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) AdminGetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.service.GetUserWithdrawals(r.Context(), getUserID(r.Context()), chi.URLParam(r, "userID"))
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get user withdrawals", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) AdminGetUserBalance(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.service.GetUserBalance(r.Context(), getUserID(r.Context()), chi.URLParam(r, "userID"))
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get user balance", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) AdminCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req models.WebhookRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	resp, err := h.service.AdminCreateWebhook(r.Context(), getUserID(r.Context()), chi.URLParam(r, "userID"), req)
+	switch {
+	case err == nil:
+		writeJSON(w, r, http.StatusCreated, resp)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, myerrors.ErrInvalid):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	default:
+		logger.FromContext(r.Context()).Error("failed to create webhook", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) AdminGetUserWebhooks(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.service.GetUserWebhooks(r.Context(), getUserID(r.Context()), chi.URLParam(r, "userID"))
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get user webhooks", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) AdminRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.AdminRedeliverWebhook(r.Context(), getUserID(r.Context()), chi.URLParam(r, "userID"), deliveryID)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		logger.FromContext(r.Context()).Error("failed to redeliver webhook", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) AdminRequeueOrder(w http.ResponseWriter, r *http.Request) {
+	err := h.service.RequeueOrder(r.Context(), getUserID(r.Context()), chi.URLParam(r, "number"))
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, myerrors.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, myerrors.ErrUnavailable):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		logger.FromContext(r.Context()).Error("failed to requeue order", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) AdminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	var req models.AdjustmentRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	resp, err := h.service.AdjustBalance(r.Context(), getUserID(r.Context()), chi.URLParam(r, "userID"), req)
+	switch {
+	case err == nil:
+		writeJSON(w, r, http.StatusCreated, resp)
+	case errors.Is(err, myerrors.ErrInvalid):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		logger.FromContext(r.Context()).Error("failed to adjust balance", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) AdminReverseOrder(w http.ResponseWriter, r *http.Request) {
+	var req models.ReversalRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	resp, err := h.service.ReverseOrderAccrual(r.Context(), getUserID(r.Context()), chi.URLParam(r, "number"), req)
+	switch {
+	case err == nil:
+		writeJSON(w, r, http.StatusCreated, resp)
+	case errors.Is(err, myerrors.ErrInvalid):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, myerrors.ErrConflict), errors.Is(err, myerrors.ErrExists):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		logger.FromContext(r.Context()).Error("failed to reverse order accrual", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) AdminGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultAdminPageSize, maxAdminPageSize)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.service.GetAuditLog(r.Context(), getUserID(r.Context()), r.URL.Query().Get("user_id"), limit)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get audit log", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) AdminRefundWithdrawal(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var req models.RefundRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	resp, err := h.service.RefundWithdrawal(r.Context(), getUserID(r.Context()), id, req)
+	switch {
+	case err == nil:
+		writeJSON(w, r, http.StatusCreated, resp)
+	case errors.Is(err, myerrors.ErrInvalid):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, myerrors.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		logger.FromContext(r.Context()).Error("failed to refund withdrawal", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
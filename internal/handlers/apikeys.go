@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/middleware"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+func (h *Handler) APIKeys() middleware.APIKeys {
+	return h.service
+}
+
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req models.APIKeyRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	userID := getUserID(r.Context())
+	resp, err := h.service.CreateAPIKey(r.Context(), userID, req)
+	if err != nil {
+		if errors.Is(err, myerrors.ErrInvalid) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		logger.FromContext(r.Context()).Error("failed to create api key", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+	}
+}
+
+func (h *Handler) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+	resp, err := h.service.GetAPIKeys(r.Context(), userID)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get api keys", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+	err := h.service.DeleteAPIKey(r.Context(), userID, chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, myerrors.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.FromContext(r.Context()).Error("failed to delete api key", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
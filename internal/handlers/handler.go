@@ -2,14 +2,23 @@ package handlers
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ShiraazMoollatjie/goluhn"
+	"github.com/go-chi/chi"
 	"github.com/rutkin/gofermart/internal/config"
 	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/events"
 	"github.com/rutkin/gofermart/internal/helpers"
 	"github.com/rutkin/gofermart/internal/logger"
 	"github.com/rutkin/gofermart/internal/models"
@@ -17,24 +26,89 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	maxOrdersStatusNumbers = 100
+	maxBatchOrders         = 1000
+	eventsHeartbeatPeriod  = 15 * time.Second
+	defaultHistoryPageSize = 100
+	maxHistoryPageSize     = 1000
+)
+
 func getRegisterRequest(r *http.Request) (models.RegisterRequest, error) {
 	var req models.RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logger.Log.Error("failed to decode body", zap.String("error", err.Error()))
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
 		return req, err
 	}
 	return req, nil
 }
 
-func setUserIDCookie(userID string, w http.ResponseWriter) {
-	encryptedUserID, err := helpers.Encode(userID)
+func getBatchOrdersRequest(r *http.Request) ([]string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []string
+	switch mediaType {
+	case "application/json":
+		if err := decodeJSON(r.Body, &numbers); err != nil {
+			return nil, err
+		}
+	case "text/csv":
+		reader := csv.NewReader(r.Body)
+		reader.FieldsPerRecord = -1
+		for {
+			record, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, field := range record {
+				if number := strings.TrimSpace(field); number != "" {
+					numbers = append(numbers, number)
+				}
+			}
+		}
+	default:
+		return nil, myerrors.ErrInvalid
+	}
+	return numbers, nil
+}
+
+func writeEvent(w io.Writer, event events.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// setUserIDCookie issues the auth token both as a cookie and as a bearer token for non-browser clients.
+func (h *Handler) setUserIDCookie(userID string, w http.ResponseWriter) {
+	encryptedUserID, err := helpers.EncodeToken(userID, h.cookie.MaxAge)
 	if err != nil {
 		logger.Log.Error("failed to encrypt userID", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	userIDcookie := &http.Cookie{Name: helpers.UserIDKey, Value: encryptedUserID}
+	userIDcookie := &http.Cookie{
+		Name:     helpers.UserIDKey,
+		Value:    encryptedUserID,
+		Path:     "/",
+		Domain:   h.cookie.Domain,
+		MaxAge:   int(h.cookie.MaxAge.Seconds()),
+		Secure:   h.cookie.Secure,
+		HttpOnly: true,
+		SameSite: h.cookie.SameSite,
+	}
 	http.SetCookie(w, userIDcookie)
+	w.Header().Set("Authorization", "Bearer "+encryptedUserID)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -48,11 +122,28 @@ func NewHandler(config *config.Config) (*Handler, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Handler{service}, nil
+	return &Handler{
+		service: service,
+		cookie: cookieConfig{
+			Secure:   config.CookieSecure,
+			SameSite: sameSiteModes[config.CookieSameSite],
+			Domain:   config.CookieDomain,
+			MaxAge:   config.CookieMaxAge,
+		},
+	}, nil
+}
+
+type cookieConfig struct {
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+	MaxAge   time.Duration
 }
 
 type Handler struct {
-	service *service.Service
+	service      *service.Service
+	cookie       cookieConfig
+	shuttingDown atomic.Bool
 }
 
 func (h *Handler) Close() {
@@ -62,11 +153,11 @@ func (h *Handler) Close() {
 func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 	req, err := getRegisterRequest(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
-	userID, err := h.service.RegisterUser(req.Login, req.Password)
+	userID, err := h.service.RegisterUser(r.Context(), req.Login, req.Password)
 	if err != nil {
 		if errors.Is(err, myerrors.ErrExists) {
 			w.WriteHeader(http.StatusConflict)
@@ -75,44 +166,44 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	setUserIDCookie(userID, w)
+	h.setUserIDCookie(userID, w)
 }
 
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 	req, err := getRegisterRequest(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
-	userID, err := h.service.Login(req.Login, req.Password)
+	userID, err := h.service.Login(r.Context(), req.Login, req.Password)
 	if err != nil {
 		if errors.Is(err, myerrors.ErrNotFound) {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 	}
-	setUserIDCookie(userID, w)
+	h.setUserIDCookie(userID, w)
 }
 
 func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	orderNumber, err := io.ReadAll(r.Body)
 	if err != nil {
-		logger.Log.Error("failed to read order number in create order request", zap.String("error", err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
+		logger.FromContext(r.Context()).Error("failed to read order number in create order request", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
 	strOrderNumber := string(orderNumber)
 	err = goluhn.Validate(strOrderNumber)
 	if err != nil {
-		logger.Log.Error("failed to validate order number", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed to validate order number", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
 	userID := getUserID(r.Context())
-	err = h.service.CreateOrder(userID, strOrderNumber)
+	err = h.service.CreateOrder(r.Context(), userID, strOrderNumber)
 	if err != nil {
 		if errors.Is(err, myerrors.ErrExists) {
 			w.WriteHeader(http.StatusOK)
@@ -122,7 +213,7 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
-		logger.Log.Error("failed to create order", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed to create order", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -130,12 +221,53 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (h *Handler) CreateOrders(w http.ResponseWriter, r *http.Request) {
+	numbers, err := getBatchOrdersRequest(r)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to read batch orders request", zap.String("error", err.Error()))
+		if errors.Is(err, myerrors.ErrInvalid) {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if len(numbers) == 0 || len(numbers) > maxBatchOrders {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userID := getUserID(r.Context())
+	resp, err := h.service.CreateOrders(r.Context(), userID, numbers)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to create orders", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	for _, rec := range resp {
+		if rec.Result == models.BatchOrderAccepted {
+			status = http.StatusAccepted
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+	}
+}
+
 func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r.Context())
-	orders, err := h.service.GetOrders(userID)
+	orders, err := h.service.GetOrders(r.Context(), userID)
 
 	if err != nil {
-		logger.Log.Error("failed to get orders", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed to get orders", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -148,19 +280,143 @@ func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(orders); err != nil {
-		logger.Log.Error("failed encode body", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) GetOrder(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+	err := goluhn.Validate(number)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to validate order number", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	userID := getUserID(r.Context())
+	order, err := h.service.GetOrder(r.Context(), userID, number)
+	if err != nil {
+		if errors.Is(err, myerrors.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.FromContext(r.Context()).Error("failed to get order", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(order); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
 
+func (h *Handler) GetOrdersStatus(w http.ResponseWriter, r *http.Request) {
+	var req models.OrdersStatusRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if len(req) == 0 || len(req) > maxOrdersStatusNumbers {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userID := getUserID(r.Context())
+	resp, err := h.service.GetOrdersStatus(r.Context(), userID, req)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get orders status", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) OrderEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.FromContext(r.Context()).Error("response writer does not support flushing")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var lastEventID uint64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		var err error
+		lastEventID, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			logger.FromContext(r.Context()).Error("failed to parse last event id", zap.String("error", err.Error()))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the stream outlives the server write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logger.FromContext(r.Context()).Warn("failed to clear write deadline", zap.String("error", err.Error()))
+	}
+
+	userID := getUserID(r.Context())
+	backlog, eventsCh, cancel := h.service.SubscribeEvents(r.Context(), userID, lastEventID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
 	w.WriteHeader(http.StatusOK)
+
+	for _, event := range backlog {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatPeriod)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-eventsCh:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
 }
 
 func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r.Context())
-	balance, err := h.service.GetBalance(userID)
+	balance, err := h.service.GetBalance(r.Context(), userID)
 	if err != nil {
-		logger.Log.Error("failed to get balance", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed to get balance", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -168,7 +424,7 @@ func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(balance); err != nil {
-		logger.Log.Error("failed encode body", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -178,19 +434,19 @@ func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 	var req models.WithdrawRecord
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logger.Log.Error("failed to decode body", zap.String("error", err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 	userID := getUserID(r.Context())
-	err := h.service.Withdraw(userID, req)
+	err := h.service.Withdraw(r.Context(), userID, req)
 	if errors.Is(err, myerrors.ErrInvalid) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	if errors.Is(err, myerrors.ErrNotEnoughtMoney) {
+	if errors.Is(err, myerrors.ErrNotEnoughtMoney) || errors.Is(err, myerrors.ErrDebt) {
 		w.WriteHeader(http.StatusPaymentRequired)
 		return
 	}
@@ -203,11 +459,33 @@ func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (h *Handler) GetBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultHistoryPageSize, maxHistoryPageSize)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userID := getUserID(r.Context())
+	resp, err := h.service.GetBalanceHistory(r.Context(), userID, limit)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get balance history", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
 func (h *Handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r.Context())
-	resp, err := h.service.GetWithdrawals(userID)
+	resp, err := h.service.GetWithdrawals(r.Context(), userID)
 	if err != nil {
-		logger.Log.Error("failed to get withdrawals", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed to get withdrawals", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -220,7 +498,7 @@ func (h *Handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(resp); err != nil {
-		logger.Log.Error("failed encode body", zap.String("error", err.Error()))
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rutkin/gofermart/internal/config"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/service"
+	"go.uber.org/zap"
+)
+
+func writeHealth(w http.ResponseWriter, status int, resp models.HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Log.Error("failed encode body", zap.String("error", err.Error()))
+	}
+}
+
+func (h *Handler) StartShutdown() {
+	h.shuttingDown.Store(true)
+	h.service.CloseEvents()
+}
+
+func (h *Handler) ApplyConfig(config *config.Config) {
+	h.service.ApplyConfig(config)
+}
+
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, models.HealthResponse{Status: service.HealthOK})
+}
+
+// Readyz reports every check with its details and is meant for the admin listener only.
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.readyz(w, r, true)
+}
+
+// PublicReadyz reports only ok or fail per check, the details stay in the logs and on the admin listener.
+func (h *Handler) PublicReadyz(w http.ResponseWriter, r *http.Request) {
+	h.readyz(w, r, false)
+}
+
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request, details bool) {
+	if h.shuttingDown.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, models.HealthResponse{
+			Status: "not_ready",
+			Checks: map[string]models.HealthCheck{"shutdown": {Status: service.HealthFail, Details: "shutting down"}},
+		})
+		return
+	}
+
+	resp, ready := h.service.Readiness(r.Context())
+	if !details {
+		for name, check := range resp.Checks {
+			resp.Checks[name] = models.HealthCheck{Status: check.Status}
+		}
+	}
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+func writeHoldError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, myerrors.ErrInvalid):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, myerrors.ErrNotEnoughtMoney), errors.Is(err, myerrors.ErrDebt):
+		w.WriteHeader(http.StatusPaymentRequired)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, myerrors.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		logger.FromContext(r.Context()).Error("failed to process hold", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) CreateHold(w http.ResponseWriter, r *http.Request) {
+	var req models.HoldRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	resp, err := h.service.CreateHold(r.Context(), getUserID(r.Context()), req)
+	if err != nil {
+		writeHoldError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, resp)
+}
+
+func (h *Handler) GetHolds(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultHistoryPageSize, maxHistoryPageSize)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.service.GetHolds(r.Context(), getUserID(r.Context()), limit)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get holds", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp, err := h.service.CaptureHold(r.Context(), getUserID(r.Context()), id)
+	if err != nil {
+		writeHoldError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (h *Handler) ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp, err := h.service.ReleaseHold(r.Context(), getUserID(r.Context()), id)
+	if err != nil {
+		writeHoldError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,10 @@
+package handlers
+
+import "github.com/rutkin/gofermart/internal/ratelimit"
+
+func (h *Handler) NewRateLimitStore(kind string) ratelimit.Store {
+	if kind == "postgres" {
+		return ratelimit.NewPostgresStore(h.service)
+	}
+	return ratelimit.NewMemoryStore()
+}
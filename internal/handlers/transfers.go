@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+func (h *Handler) Transfer(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req models.TransferRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	resp, replayed, err := h.service.Transfer(r.Context(), getUserID(r.Context()), key, req)
+	switch {
+	case err == nil:
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		writeJSON(w, r, http.StatusCreated, resp)
+	case errors.Is(err, myerrors.ErrInvalid):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, myerrors.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, myerrors.ErrNotEnoughtMoney), errors.Is(err, myerrors.ErrDebt):
+		w.WriteHeader(http.StatusPaymentRequired)
+	case errors.Is(err, myerrors.ErrLimitExceeded):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, myerrors.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req models.WebhookRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		logger.FromContext(r.Context()).Error("failed to decode body", zap.String("error", err.Error()))
+		w.WriteHeader(bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	userID := getUserID(r.Context())
+	resp, err := h.service.CreateWebhook(r.Context(), userID, req)
+	if err != nil {
+		if errors.Is(err, myerrors.ErrInvalid) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		logger.FromContext(r.Context()).Error("failed to create webhook", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+	}
+}
+
+func (h *Handler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+	resp, err := h.service.GetWebhooks(r.Context(), userID)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get webhooks", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+	err := h.service.DeleteWebhook(r.Context(), userID, chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, myerrors.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.FromContext(r.Context()).Error("failed to delete webhook", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+	resp, err := h.service.GetWebhookDeliveries(r.Context(), userID, chi.URLParam(r, "id"))
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get webhook deliveries", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		logger.FromContext(r.Context()).Error("failed encode body", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userID := getUserID(r.Context())
+	err = h.service.RedeliverWebhook(r.Context(), userID, deliveryID)
+	if err != nil {
+		if errors.Is(err, myerrors.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.FromContext(r.Context()).Error("failed to redeliver webhook", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
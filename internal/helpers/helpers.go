@@ -3,8 +3,13 @@ package helpers
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rutkin/gofermart/internal/logger"
 	"go.uber.org/zap"
@@ -16,54 +21,101 @@ type contextKey string
 
 var UserIDContextKey contextKey = contextKey(UserIDKey)
 
-const password = "password"
+var password string
 
-func Encode(value string) (string, error) {
+var errNoSecret = errors.New("cookie secret is not set")
+
+var ErrTokenExpired = errors.New("token expired")
+
+var errMalformedToken = errors.New("malformed token")
+
+func SetSecret(secret string) {
+	password = secret
+}
+
+func newGCM() (cipher.AEAD, error) {
+	if password == "" {
+		return nil, errNoSecret
+	}
 	key := sha256.Sum256([]byte(password))
 	aesblock, err := aes.NewCipher(key[:])
 	if err != nil {
 		logger.Log.Error("failed to create new cipher", zap.String("error", err.Error()))
-		return "", err
+		return nil, err
 	}
 
 	aesgcm, err := cipher.NewGCM(aesblock)
 	if err != nil {
 		logger.Log.Error("failed to create new gcm", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return aesgcm, nil
+}
+
+// Encode seals the value with a random nonce prepended to the result.
+func Encode(value string) (string, error) {
+	aesgcm, err := newGCM()
+	if err != nil {
 		return "", err
 	}
 
-	nonce := key[(len(key) - aesgcm.NonceSize()):]
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		logger.Log.Error("failed to generate nonce", zap.String("error", err.Error()))
+		return "", err
+	}
 
-	encryptedValue := aesgcm.Seal(nil, nonce, []byte(value), nil)
+	encryptedValue := aesgcm.Seal(nonce, nonce, []byte(value), nil)
 	return hex.EncodeToString(encryptedValue), nil
 }
 
 func Decode(value string) (string, error) {
-	key := sha256.Sum256([]byte(password))
-	aesblock, err := aes.NewCipher(key[:])
-	if err != nil {
-		logger.Log.Error("failed to create new cipher", zap.String("error", err.Error()))
-		return "", err
-	}
-
-	aesgcm, err := cipher.NewGCM(aesblock)
+	aesgcm, err := newGCM()
 	if err != nil {
-		logger.Log.Error("failed to create new gcm", zap.String("error", err.Error()))
 		return "", err
 	}
 
-	nonce := key[(len(key) - aesgcm.NonceSize()):]
-
 	data, err := hex.DecodeString(value)
 	if err != nil {
 		logger.Log.Error("failed to decode", zap.String("error", err.Error()))
 		return "", err
 	}
+	if len(data) < aesgcm.NonceSize() {
+		return "", errMalformedToken
+	}
 
-	decodedValue, err := aesgcm.Open(nil, nonce, data, nil)
+	nonce, encryptedValue := data[:aesgcm.NonceSize()], data[aesgcm.NonceSize():]
+	decodedValue, err := aesgcm.Open(nil, nonce, encryptedValue, nil)
 	if err != nil {
 		logger.Log.Error("failed to decrypt", zap.String("error", err.Error()))
 		return "", err
 	}
 	return string(decodedValue), err
 }
+
+// EncodeToken seals the userID together with the time the token expires at.
+func EncodeToken(userID string, ttl time.Duration) (string, error) {
+	expires := time.Now().Add(ttl).Unix()
+	return Encode(strconv.FormatInt(expires, 10) + ":" + userID)
+}
+
+// DecodeToken opens a token made by EncodeToken, failing with ErrTokenExpired once it is past its expiry.
+func DecodeToken(token string) (string, error) {
+	value, err := Decode(token)
+	if err != nil {
+		return "", err
+	}
+
+	expiresValue, userID, ok := strings.Cut(value, ":")
+	if !ok || userID == "" {
+		return "", errMalformedToken
+	}
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	if err != nil {
+		return "", errMalformedToken
+	}
+	if time.Now().Unix() >= expires {
+		return "", ErrTokenExpired
+	}
+	return userID, nil
+}
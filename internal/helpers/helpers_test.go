@@ -0,0 +1,119 @@
+package helpers
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func withSecret(t *testing.T, secret string) {
+	t.Helper()
+	previous := password
+	SetSecret(secret)
+	t.Cleanup(func() { SetSecret(previous) })
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	withSecret(t, "secret")
+
+	token, err := EncodeToken("user-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := DecodeToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != "user-1" {
+		t.Fatalf("userID = %q, want user-1", userID)
+	}
+}
+
+func TestTokensUseFreshNonce(t *testing.T) {
+	withSecret(t, "secret")
+
+	first, err := EncodeToken("user-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EncodeToken("user-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("two tokens for the same user are identical")
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	withSecret(t, "secret")
+
+	token, err := EncodeToken("user-1", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeToken(token); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("error = %v, want %v", err, ErrTokenExpired)
+	}
+}
+
+func TestRejectedTokens(t *testing.T) {
+	withSecret(t, "secret")
+
+	token, err := EncodeToken("user-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := hex.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	tampered := hex.EncodeToString(raw)
+
+	// a plain Encode has no expiry and must not pass as a token
+	untimed, err := Encode("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered", tampered},
+		{"truncated", token[:len(token)-2]},
+		{"not hex", "zz" + token[2:]},
+		{"shorter than nonce", "abcd"},
+		{"empty", ""},
+		{"without expiry", untimed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if userID, err := DecodeToken(tt.token); err == nil {
+				t.Fatalf("DecodeToken accepted %s token for %q", tt.name, userID)
+			}
+		})
+	}
+}
+
+func TestTokenFromOtherSecret(t *testing.T) {
+	withSecret(t, "secret")
+	token, err := EncodeToken("user-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetSecret("other")
+	if _, err := DecodeToken(token); err == nil {
+		t.Fatal("token sealed with another secret accepted")
+	}
+}
+
+func TestNoSecret(t *testing.T) {
+	withSecret(t, "")
+	if _, err := EncodeToken("user-1", time.Hour); !errors.Is(err, errNoSecret) {
+		t.Fatalf("error = %v, want %v", err, errNoSecret)
+	}
+}
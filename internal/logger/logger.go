@@ -1,17 +1,26 @@
 package logger
 
-import "go.uber.org/zap"
+import (
+	"context"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
 
 var Log *zap.Logger = zap.NewNop()
 
+// Level is shared by all loggers and can be changed at runtime.
+var Level = zap.NewAtomicLevel()
+
+type contextKey struct{}
+
 func Initialize(level string) error {
-	lvl, err := zap.ParseAtomicLevel(level)
-	if err != nil {
+	if err := SetLevel(level); err != nil {
 		return err
 	}
 
 	cfg := zap.NewProductionConfig()
-	cfg.Level = lvl
+	cfg.Level = Level
 
 	zl, err := cfg.Build()
 	if err != nil {
@@ -21,3 +30,27 @@ func Initialize(level string) error {
 	Log = zl
 	return nil
 }
+
+func SetLevel(level string) error {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Level.SetLevel(lvl)
+	return nil
+}
+
+func WithContext(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+func FromContext(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return Log
+}
+
+func With(ctx context.Context, fields ...zap.Field) context.Context {
+	return WithContext(ctx, FromContext(ctx).With(fields...))
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+const namespace = "gophermart"
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route and status code.",
+	}, []string{"method", "route", "code"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	Registrations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Number of registered users.",
+	})
+
+	OrdersCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_created_total",
+		Help:      "Number of accepted orders.",
+	})
+
+	AccrualRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_requests_total",
+		Help:      "Number of accrual system requests by outcome.",
+	}, []string{"outcome"})
+
+	AccrualDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "accrual_request_duration_seconds",
+		Help:      "Accrual system request latency.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	Withdrawals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "withdrawals_total",
+		Help:      "Number of withdrawals by result.",
+	}, []string{"result"})
+
+	Transfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transfers_total",
+		Help:      "Number of balance transfers by result.",
+	}, []string{"result"})
+
+	ExpiredPoints = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "expired_points_total",
+		Help:      "Number of points written off on expiry.",
+	})
+
+	SweptOrders = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "swept_orders_total",
+		Help:      "Number of stuck orders handled by the sweeper by result.",
+	}, []string{"result"})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected by rate limiting by route group.",
+	}, []string{"group"})
+)
+
+type StoreStats interface {
+	CountOrdersByStatus(ctx context.Context) (map[string]int, error)
+	GetTotalLiability(ctx context.Context) (float64, error)
+}
+
+type storeCollector struct {
+	store     StoreStats
+	orders    *prometheus.Desc
+	liability *prometheus.Desc
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.orders
+	ch <- c.liability
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	orders, err := c.store.CountOrdersByStatus(context.Background())
+	if err != nil {
+		logger.Log.Error("failed to collect orders metrics", zap.String("error", err.Error()))
+	}
+	for status, count := range orders {
+		ch <- prometheus.MustNewConstMetric(c.orders, prometheus.GaugeValue, float64(count), status)
+	}
+
+	liability, err := c.store.GetTotalLiability(context.Background())
+	if err != nil {
+		logger.Log.Error("failed to collect liability metrics", zap.String("error", err.Error()))
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.liability, prometheus.GaugeValue, liability)
+}
+
+func register(collector prometheus.Collector) {
+	err := prometheus.Register(collector)
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if err != nil && !errors.As(err, &alreadyRegistered) {
+		logger.Log.Error("failed to register metrics collector", zap.String("error", err.Error()))
+	}
+}
+
+func RegisterStore(store StoreStats) {
+	register(&storeCollector{
+		store:     store,
+		orders:    prometheus.NewDesc(namespace+"_orders", "Number of orders by status.", []string{"status"}, nil),
+		liability: prometheus.NewDesc(namespace+"_points_liability", "Total points available on user balances.", nil, nil),
+	})
+}
+
+func RegisterDB(db *sql.DB) {
+	register(collectors.NewDBStatsCollector(db, namespace))
+}
+
+func RegisterQueueDepth(depth func() float64) {
+	register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "orders_queue_depth",
+		Help:      "Number of orders waiting for accrual processing.",
+	}, depth))
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/helpers"
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+func WithAdminToken(token string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(value), []byte(token)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+type Roles interface {
+	GetUserRole(ctx context.Context, userID string) (string, error)
+}
+
+// RequireRole rejects users without the role and must run after WithAuth.
+func RequireRole(roles Roles, role string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			userID, _ := r.Context().Value(helpers.UserIDContextKey).(string)
+			userRole, err := roles.GetUserRole(r.Context(), userID)
+			if errors.Is(err, myerrors.ErrNotFound) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				logger.FromContext(r.Context()).Error("failed to get user role", zap.String("error", err.Error()))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if userRole != role {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -2,33 +2,107 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"slices"
+	"strings"
 
 	myerrors "github.com/rutkin/gofermart/internal/errors"
 	"github.com/rutkin/gofermart/internal/helpers"
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
 )
 
+const APIKeyHeader = "X-Api-Key"
+
+type APIKeys interface {
+	AuthenticateAPIKey(ctx context.Context, key string) (string, []string, error)
+}
+
+type scopesKey struct{}
+
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func GetUserIDFromRequest(r *http.Request) (string, error) {
+	if token, ok := bearerToken(r); ok {
+		return helpers.DecodeToken(token)
+	}
+	return GetUserIDFromCookie(r)
+}
+
 func GetUserIDFromCookie(r *http.Request) (string, error) {
 	userIDCookie, err := r.Cookie(helpers.UserIDKey)
 	if err != nil {
 		return "", myerrors.ErrNotFound
 	}
 
-	userID, err := helpers.Decode(userIDCookie.Value)
+	userID, err := helpers.DecodeToken(userIDCookie.Value)
 	return userID, err
 }
 
-func WithAuth(h http.Handler) http.Handler {
-	authFn := func(w http.ResponseWriter, r *http.Request) {
-		userID, err := GetUserIDFromCookie(r)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+// WithAuth authenticates requests by API key, bearer token or auth cookie. Requests
+// authenticated by API key carry the key scopes, others have full access.
+func WithAuth(keys APIKeys) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		authFn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			var userID string
+			if key := r.Header.Get(APIKeyHeader); key != "" {
+				var scopes []string
+				var err error
+				userID, scopes, err = keys.AuthenticateAPIKey(ctx, key)
+				if errors.Is(err, myerrors.ErrNotFound) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					logger.FromContext(ctx).Error("failed to authenticate api key", zap.String("error", err.Error()))
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				ctx = context.WithValue(ctx, scopesKey{}, scopes)
+			} else {
+				var err error
+				userID, err = GetUserIDFromRequest(r)
+				if err != nil {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			ctx = context.WithValue(ctx, helpers.UserIDContextKey, userID)
+			ctx = setLoggedUser(ctx, userID)
+			h.ServeHTTP(w, r.WithContext(ctx))
 		}
 
-		ctx := context.WithValue(r.Context(), helpers.UserIDContextKey, userID)
-		h.ServeHTTP(w, r.WithContext(ctx))
+		return http.HandlerFunc(authFn)
 	}
+}
 
-	return http.HandlerFunc(authFn)
+// RequireScope rejects API key requests without the scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if scopes, ok := r.Context().Value(scopesKey{}).([]string); ok && !slices.Contains(scopes, scope) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// RequireSession rejects API key requests, so keys can not manage other keys.
+func RequireSession(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(scopesKey{}).([]string); ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
 }
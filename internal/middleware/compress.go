@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+var gzipWriters = sync.Pool{New: func() any {
+	return gzip.NewWriter(io.Discard)
+}}
+
+// compressibleType reports whether responses of the content type are worth compressing.
+// Event streams are excluded since every event has to be flushed as is.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
+
+// acceptedEncoding picks gzip or deflate from Accept-Encoding honoring q-values, or "" for identity.
+// The "*" wildcard only covers encodings the header doesn't name explicitly.
+func acceptedEncoding(header string) string {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, name := range []string{"gzip", "deflate"} {
+		q, ok := weights[name]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	writer  io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.writer != nil {
+			return cw.writer.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf.Write(p)
+	if cw.buf.Len() >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends headers and the buffered body, compressing if the body is large enough.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if compressibleType(header.Get("Content-Type")) {
+		header.Add("Vary", "Accept-Encoding")
+		if large && header.Get("Content-Encoding") == "" &&
+			cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+			header.Set("Content-Encoding", cw.encoding)
+			header.Del("Content-Length")
+			if cw.encoding == "gzip" {
+				gw := gzipWriters.Get().(*gzip.Writer)
+				gw.Reset(cw.ResponseWriter)
+				cw.writer = gw
+			} else {
+				fw, err := flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+				if err != nil {
+					return err
+				}
+				cw.writer = fw
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.writer != nil {
+		_, err = cw.writer.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(false); err != nil {
+			return
+		}
+	}
+	if gw, ok := cw.writer.(*gzip.Writer); ok {
+		gw.Flush()
+	} else if fw, ok := cw.writer.(*flate.Writer); ok {
+		fw.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() error {
+	if !cw.decided {
+		if cw.status == 0 && cw.buf.Len() == 0 {
+			return nil
+		}
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.writer == nil {
+		return nil
+	}
+	err := cw.writer.Close()
+	if gw, ok := cw.writer.(*gzip.Writer); ok {
+		gzipWriters.Put(gw)
+	}
+	return err
+}
+
+// decompressBody replaces gzip or deflate encoded body with decoded one limited to maxSize bytes.
+func decompressBody(w http.ResponseWriter, r *http.Request, maxSize int64) bool {
+	var body io.ReadCloser
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return true
+	case "gzip":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			logger.FromContext(r.Context()).Error("failed to read gzip body", zap.String("error", err.Error()))
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		body = gr
+	case "deflate":
+		body = flate.NewReader(r.Body)
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, body, maxSize)
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return true
+}
+
+// WithDecompression decodes compressed request bodies up to maxSize bytes. It goes after
+// WithMaxBytes, so that limits the compressed size.
+func WithDecompression(maxSize int64) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if decompressBody(w, r, maxSize) {
+				h.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// WithCompression compresses json and text responses of at least minSize bytes.
+func WithCompression(minSize int) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+			defer func() {
+				if err := cw.close(); err != nil {
+					logger.FromContext(r.Context()).Error("failed to write compressed response", zap.String("error", err.Error()))
+				}
+			}()
+			h.ServeHTTP(cw, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"br, gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=0.5, deflate;q=0.8", "deflate"},
+		{"deflate;q=0.5, gzip;q=0.5", "gzip"},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"gzip;q=0, deflate;q=0, *", ""},
+		{"gzip;q=abc", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := acceptedEncoding(tt.header); got != tt.want {
+				t.Fatalf("acceptedEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func serveCompressed(t *testing.T, minSize int, contentType string, body string, acceptEncoding string) *httptest.ResponseRecorder {
+	t.Helper()
+	handler := WithCompression(minSize)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, body)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCompressionLargeJSON(t *testing.T) {
+	body := `{"data":"` + strings.Repeat("a", 2048) + `"}`
+	w := serveCompressed(t, 1024, "application/json", body, "gzip")
+
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != body {
+		t.Fatalf("decoded body differs from the original")
+	}
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	large := strings.Repeat("a", 2048)
+	tests := []struct {
+		name           string
+		contentType    string
+		body           string
+		acceptEncoding string
+	}{
+		{"below min size", "application/json", `{"a":1}`, "gzip"},
+		{"event stream", "text/event-stream", large, "gzip"},
+		{"binary", "image/png", large, "gzip"},
+		{"refused with q=0", "application/json", large, "gzip;q=0"},
+		{"no accept encoding", "application/json", large, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveCompressed(t, 1024, tt.contentType, tt.body, tt.acceptEncoding)
+			if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Fatalf("Content-Encoding = %q, want none", got)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Fatalf("body = %q, want it unchanged", got)
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompression(t *testing.T) {
+	const maxSize = 1024
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		tooLarge bool
+	}{
+		{"plain", "", []byte(`{"a":1}`), http.StatusOK, false},
+		{"gzip", "gzip", gzipped(t, []byte(`{"a":1}`)), http.StatusOK, false},
+		{"zip bomb", "gzip", gzipped(t, make([]byte, 1<<20)), http.StatusOK, true},
+		{"broken gzip", "gzip", []byte("not gzip"), http.StatusBadRequest, false},
+		{"unsupported", "br", []byte("x"), http.StatusUnsupportedMediaType, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var readErr error
+			handler := WithDecompression(maxSize)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Encoding") != "" {
+					t.Error("Content-Encoding left on decoded request")
+				}
+				_, readErr = io.ReadAll(r.Body)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			var maxBytesErr *http.MaxBytesError
+			if got := errors.As(readErr, &maxBytesErr); got != tt.tooLarge {
+				t.Fatalf("read error = %v, want too large %v", readErr, tt.tooLarge)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rutkin/gofermart/internal/helpers"
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func sameOrigin(r *http.Request, trusted map[string]bool) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	switch origin {
+	case "":
+		// browsers omitting Origin still send Sec-Fetch-Site
+		switch r.Header.Get("Sec-Fetch-Site") {
+		case "", "same-origin", "none":
+			return true
+		}
+		return false
+	case "null":
+		return false
+	}
+	if trusted[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// WithCSRF rejects cross-site state changing requests authenticated by the auth cookie.
+// Requests with bearer tokens or API keys are exempt, browsers never attach those on their own.
+// Non-browser clients do not send Origin or Sec-Fetch-Site and pass as well.
+func WithCSRF(trustedOrigins string) func(http.Handler) http.Handler {
+	trusted := make(map[string]bool)
+	for _, origin := range strings.Split(trustedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			trusted[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if safeMethod(r.Method) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if _, ok := bearerToken(r); ok || r.Header.Get(APIKeyHeader) != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if _, err := r.Cookie(helpers.UserIDKey); err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if sameOrigin(r, trusted) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			logger.FromContext(r.Context()).Warn("rejected cross-site request",
+				zap.String("origin", r.Header.Get("Origin")), zap.String("secFetchSite", r.Header.Get("Sec-Fetch-Site")))
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
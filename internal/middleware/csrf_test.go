@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rutkin/gofermart/internal/helpers"
+)
+
+func TestCSRF(t *testing.T) {
+	handler := WithCSRF("https://app.example.com/")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name    string
+		method  string
+		cookie  bool
+		headers map[string]string
+		status  int
+	}{
+		{"same origin post", http.MethodPost, true, map[string]string{"Origin": "https://api.example.com"}, http.StatusOK},
+		{"same origin case insensitive", http.MethodPost, true, map[string]string{"Origin": "HTTPS://API.EXAMPLE.COM"}, http.StatusOK},
+		{"trusted origin", http.MethodPost, true, map[string]string{"Origin": "https://app.example.com"}, http.StatusOK},
+		{"cross site post", http.MethodPost, true, map[string]string{"Origin": "https://evil.example.org"}, http.StatusForbidden},
+		{"cross site delete", http.MethodDelete, true, map[string]string{"Origin": "https://evil.example.org"}, http.StatusForbidden},
+		{"null origin", http.MethodPost, true, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"cross site fetch metadata", http.MethodPost, true, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same site fetch metadata", http.MethodPost, true, map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"same origin fetch metadata", http.MethodPost, true, map[string]string{"Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{"user initiated", http.MethodPost, true, map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK},
+		{"non browser client", http.MethodPost, true, nil, http.StatusOK},
+		{"cross site get", http.MethodGet, true, map[string]string{"Origin": "https://evil.example.org"}, http.StatusOK},
+		{"cross site without cookie", http.MethodPost, false, map[string]string{"Origin": "https://evil.example.org"}, http.StatusOK},
+		{"cross site with bearer", http.MethodPost, true, map[string]string{"Origin": "https://evil.example.org", "Authorization": "Bearer token"}, http.StatusOK},
+		{"cross site with api key", http.MethodPost, true, map[string]string{"Origin": "https://evil.example.org", APIKeyHeader: "key"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "https://api.example.com/api/user/orders", nil)
+			if tt.cookie {
+				r.AddCookie(&http.Cookie{Name: helpers.UserIDKey, Value: "token"})
+			}
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	RequestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+	redacted           = "[REDACTED]"
+)
+
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Accrual-Signature": true,
+}
+
+type requestLogKey struct{}
+
+type requestLog struct {
+	userID string
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func redactHeaders(header http.Header) map[string]string {
+	result := make(map[string]string, len(header))
+	for name, values := range header {
+		if sensitiveHeaders[name] {
+			result[name] = redacted
+			continue
+		}
+		if len(values) > 0 {
+			result[name] = values[0]
+		}
+	}
+	return result
+}
+
+func setLoggedUser(ctx context.Context, userID string) context.Context {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.userID = userID
+	}
+	return logger.With(ctx, zap.String("userID", userID))
+}
+
+func WithLogging(h http.Handler) http.Handler {
+	loggingFn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		fields := []zap.Field{zap.String("requestID", requestID)}
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+			fields = append(fields, zap.String("traceID", spanContext.TraceID().String()))
+		}
+		ctx := logger.With(r.Context(), fields...)
+
+		rl := &requestLog{}
+		ctx = context.WithValue(ctx, requestLogKey{}, rl)
+
+		reqLogger := logger.FromContext(ctx)
+		if ce := reqLogger.Check(zap.DebugLevel, "request headers"); ce != nil {
+			ce.Write(zap.Any("headers", redactHeaders(r.Header)))
+		}
+
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		h.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		reqLogger.Info("request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", status),
+			zap.Int("bytes", ww.BytesWritten()),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("remoteAddr", r.RemoteAddr),
+			zap.String("userID", rl.userID))
+	}
+
+	return http.HandlerFunc(loggingFn)
+}
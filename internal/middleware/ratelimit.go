@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/helpers"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/metrics"
+	"github.com/rutkin/gofermart/internal/ratelimit"
+	"go.uber.org/zap"
+)
+
+type RateLimitKey func(r *http.Request) string
+
+// UserRateLimitKey keys requests on the authenticated user and must run after WithAuth.
+func UserRateLimitKey(r *http.Request) string {
+	userID, _ := r.Context().Value(helpers.UserIDContextKey).(string)
+	return "user:" + userID
+}
+
+func IPRateLimitKey(clientIP *ratelimit.ClientIP) RateLimitKey {
+	return func(r *http.Request) string {
+		return "ip:" + clientIP.Get(r)
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func WithRateLimit(limiter *ratelimit.Limiter, key RateLimitKey) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Limit().Enabled() {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			result, err := limiter.Take(r.Context(), key(r))
+			if err != nil {
+				logger.FromContext(r.Context()).Error("failed to check rate limit, allowing request",
+					zap.String("group", limiter.Name()), zap.String("error", err.Error()))
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", seconds(result.Reset))
+			if !result.Allowed {
+				metrics.RateLimited.WithLabelValues(limiter.Name()).Inc()
+				w.Header().Set("Retry-After", seconds(result.RetryAfter))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
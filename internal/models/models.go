@@ -1,10 +1,19 @@
 package models
 
+import "encoding/json"
+
 type RegisterRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
+const (
+	OrderNew        = "NEW"
+	OrderProcessing = "PROCESSING"
+	OrderInvalid    = "INVALID"
+	OrderProcessed  = "PROCESSED"
+)
+
 type OrderRecord struct {
 	Number     string  `json:"number"`
 	Status     string  `json:"status"`
@@ -14,15 +23,63 @@ type OrderRecord struct {
 
 type OrdersResponse []OrderRecord
 
+type OrderHistoryRecord struct {
+	Status  string  `json:"status"`
+	Accrual float32 `json:"accrual,omitempty"`
+	Date    string  `json:"date"`
+}
+
+type OrderResponse struct {
+	OrderRecord
+	History []OrderHistoryRecord `json:"history"`
+}
+
+const (
+	BatchOrderAccepted = "accepted"
+	BatchOrderUploaded = "already_uploaded"
+	BatchOrderConflict = "conflict"
+	BatchOrderInvalid  = "invalid"
+)
+
+type BatchOrderRecord struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
+}
+
+type OrdersStatusRequest []string
+
+type OrderStatusRecord struct {
+	Number  string  `json:"number"`
+	Status  string  `json:"status"`
+	Accrual float32 `json:"accrual,omitempty"`
+}
+
+type OrderTaskRecord struct {
+	UserID   string
+	Number   string
+	Attempts int
+}
+
 type LoyaltyOrderRecord struct {
 	Number  string  `json:"order"`
 	Status  string  `json:"status"`
 	Accrual float32 `json:"accrual,omitempty"`
 }
 
+type ExpiringPoints struct {
+	Amount    float32 `json:"amount"`
+	ExpiresAt string  `json:"expires_at"`
+}
+
+// BalanceRecord reports points reserved by active holds as held and the rest as current. Of current
+// only available points can be spent, pending ones are accrued by orders still in the cooling-off period.
 type BalanceRecord struct {
-	Current   float32 `json:"current"`
-	Withdrawn float32 `json:"withdrawn"`
+	Current   float32          `json:"current"`
+	Pending   float32          `json:"pending"`
+	Available float32          `json:"available"`
+	Held      float32          `json:"held"`
+	Withdrawn float32          `json:"withdrawn"`
+	Expiring  []ExpiringPoints `json:"expiring,omitempty"`
 }
 
 type WithdrawRecord struct {
@@ -30,8 +87,240 @@ type WithdrawRecord struct {
 	Sum    float32 `json:"sum"`
 }
 
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+	HoldExpired  = "expired"
+)
+
+type HoldRequest struct {
+	Number string  `json:"order"`
+	Sum    float32 `json:"sum"`
+	TTL    int     `json:"ttl,omitempty"`
+}
+
+type HoldRecord struct {
+	ID           int64   `json:"id"`
+	Number       string  `json:"order"`
+	Sum          float32 `json:"sum"`
+	Status       string  `json:"status"`
+	WithdrawalID int64   `json:"withdrawal_id,omitempty"`
+	CreatedAt    string  `json:"created_at"`
+	ExpiresAt    string  `json:"expires_at"`
+}
+
+type TransferRequest struct {
+	Login string  `json:"login"`
+	Sum   float32 `json:"sum"`
+}
+
+type TransferRecord struct {
+	ID        int64   `json:"id"`
+	ToUserID  string  `json:"-"`
+	Login     string  `json:"login"`
+	Sum       float32 `json:"sum"`
+	CreatedAt string  `json:"created_at"`
+}
+
+const (
+	WithdrawalCompleted         = "completed"
+	WithdrawalRefunded          = "refunded"
+	WithdrawalPartiallyRefunded = "partially_refunded"
+)
+
 type WithdrawalResponse struct {
+	ID          int64   `json:"id"`
 	Number      string  `json:"order"`
 	Sum         float32 `json:"sum"`
+	Status      string  `json:"status"`
+	Refunded    float32 `json:"refunded,omitempty"`
 	ProcessedAt string  `json:"pocessed_at"`
 }
+
+type RefundRequest struct {
+	Amount float32 `json:"amount,omitempty"`
+	Reason string  `json:"reason"`
+}
+
+type RefundRecord struct {
+	ID           int64   `json:"id"`
+	WithdrawalID int64   `json:"withdrawal_id"`
+	UserID       string  `json:"user_id"`
+	Order        string  `json:"order"`
+	Amount       float32 `json:"amount"`
+	Reason       string  `json:"reason"`
+	Actor        string  `json:"actor"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+const (
+	WebhookOrderProcessed     = "order.processed"
+	WebhookWithdrawalCreated  = "withdrawal.created"
+	WebhookWithdrawalRefunded = "withdrawal.refunded"
+)
+
+const (
+	WebhookDeliveryPending   = "PENDING"
+	WebhookDeliveryDelivered = "DELIVERED"
+	WebhookDeliveryDead      = "DEAD"
+)
+
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+}
+
+type WebhookRecord struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type WebhookPayload struct {
+	Event     string `json:"event"`
+	UserID    string `json:"user_id"`
+	Data      any    `json:"data"`
+	CreatedAt string `json:"created_at"`
+}
+
+type WebhookDeliveryRecord struct {
+	ID          int64  `json:"id"`
+	WebhookID   string `json:"webhook_id"`
+	Event       string `json:"event"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	NextAttempt string `json:"next_attempt"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID       int64
+	Event    string
+	Payload  []byte
+	Attempts int
+	URL      string
+	Secret   string
+}
+
+type BalanceDiscrepancy struct {
+	UserID            string  `json:"user_id"`
+	Current           float32 `json:"current"`
+	ExpectedCurrent   float32 `json:"expected_current"`
+	Withdrawn         float32 `json:"withdrawn"`
+	ExpectedWithdrawn float32 `json:"expected_withdrawn"`
+	Fixed             bool    `json:"fixed"`
+}
+
+type HealthCheck struct {
+	Status  string `json:"status"`
+	Details string `json:"details,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+const (
+	ScopeOrdersRead    = "orders:read"
+	ScopeOrdersWrite   = "orders:write"
+	ScopeBalanceRead   = "balance:read"
+	ScopeBalanceWrite  = "balance:write"
+	ScopeWebhooksRead  = "webhooks:read"
+	ScopeWebhooksWrite = "webhooks:write"
+)
+
+var APIKeyScopes = []string{
+	ScopeOrdersRead, ScopeOrdersWrite,
+	ScopeBalanceRead, ScopeBalanceWrite,
+	ScopeWebhooksRead, ScopeWebhooksWrite,
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type APIKeyRecord struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	Key        string   `json:"key,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+type AdminUserRecord struct {
+	UserID    string  `json:"user_id"`
+	Login     string  `json:"login"`
+	Role      string  `json:"role"`
+	Current   float32 `json:"current"`
+	Withdrawn float32 `json:"withdrawn"`
+}
+
+const (
+	AdjustmentGoodwill      = "goodwill"
+	AdjustmentCorrection    = "correction"
+	AdjustmentFraud         = "fraud"
+	AdjustmentChargeback    = "chargeback"
+	AdjustmentOrderReversal = "order_reversal"
+)
+
+type AdjustmentRequest struct {
+	Amount float32 `json:"amount"`
+	Code   string  `json:"code"`
+	Reason string  `json:"reason"`
+}
+
+type ReversalRequest struct {
+	Reason string `json:"reason"`
+}
+
+type AdjustmentRecord struct {
+	ID          int64   `json:"id"`
+	UserID      string  `json:"user_id"`
+	Amount      float32 `json:"amount"`
+	Code        string  `json:"code"`
+	OrderNumber string  `json:"order,omitempty"`
+	Reason      string  `json:"reason"`
+	Actor       string  `json:"actor"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+const (
+	HistoryAccrual    = "accrual"
+	HistoryWithdrawal = "withdrawal"
+	HistoryAdjustment = "adjustment"
+	HistoryRefund     = "refund"
+	HistoryTransfer   = "transfer"
+	HistoryExpiration = "expiration"
+)
+
+type BalanceHistoryRecord struct {
+	Type      string  `json:"type"`
+	Amount    float32 `json:"amount"`
+	Order     string  `json:"order,omitempty"`
+	Code      string  `json:"code,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Login     string  `json:"login,omitempty"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type AuditRecord struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	UserID    string          `json:"user_id,omitempty"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt string          `json:"created_at"`
+}
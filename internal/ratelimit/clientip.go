@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP resolves the client address, trusting X-Forwarded-For only when set by known proxies.
+type ClientIP struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIP parses a comma separated list of trusted proxy addresses or CIDRs.
+func NewClientIP(trustedProxies string) (*ClientIP, error) {
+	c := &ClientIP{}
+	for _, value := range strings.Split(trustedProxies, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			c.trusted = append(c.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		c.trusted = append(c.trusted, prefix.Masked())
+	}
+	return c, nil
+}
+
+func (c *ClientIP) isTrusted(value string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get walks X-Forwarded-For from the nearest hop and returns the first untrusted address.
+func (c *ClientIP) Get(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !c.isTrusted(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !c.isTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewClientIP(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"", false},
+		{"10.0.0.1", false},
+		{"10.0.0.0/8, 192.168.0.0/16", false},
+		{"::1, fd00::/8", false},
+		{" 10.0.0.1 ,, ", false},
+		{"proxy.local", true},
+		{"10.0.0.0/33", true},
+		{"10.0.0.1, nope", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			_, err := NewClientIP(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewClientIP(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientIPGet(t *testing.T) {
+	clientIP, err := NewClientIP("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"no proxy", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer ignores header", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:1234", []string{"198.51.100.1, 10.0.0.5, 10.0.0.3"}, "198.51.100.1"},
+		{"spoofed leftmost hop", "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"multiple headers", "10.0.0.2:1234", []string{"1.2.3.4", "198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"empty hops skipped", "10.0.0.2:1234", []string{"198.51.100.1, , "}, "198.51.100.1"},
+		{"malformed hop is the client", "10.0.0.2:1234", []string{"1.2.3.4, garbage"}, "garbage"},
+		{"all hops trusted", "10.0.0.2:1234", []string{"10.0.0.9"}, "10.0.0.9"},
+		{"trusted proxy without header", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"ipv6 trusted proxy", "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"remote addr without port", "203.0.113.7", nil, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP.Get(r); got != tt.want {
+				t.Fatalf("Get() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPUnmapsIPv4(t *testing.T) {
+	clientIP, err := NewClientIP("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[::ffff:10.0.0.2]:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := clientIP.Get(r); got != "198.51.100.1" {
+		t.Fatalf("Get() = %q, want 198.51.100.1", got)
+	}
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second up to Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// ParseLimit parses limits like "10/s", "60/m" or "1000/h". Empty string or "0" disables limiting.
+func ParseLimit(value string) (Limit, error) {
+	if value == "" || value == "0" {
+		return Limit{}, nil
+	}
+
+	count, unit, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected count/unit", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit count %q", count)
+	}
+
+	var period time.Duration
+	switch unit {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid rate limit unit %q, expected s, m or h", unit)
+	}
+	return Limit{Rate: float64(burst) / period.Seconds(), Burst: burst}, nil
+}
+
+// wait returns time until the bucket holding tokens has want tokens.
+func (l Limit) wait(tokens float64, want float64) time.Duration {
+	if tokens >= want {
+		return 0
+	}
+	return time.Duration(math.Ceil((want - tokens) / l.Rate * float64(time.Second)))
+}
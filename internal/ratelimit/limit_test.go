@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Limit
+		wantErr bool
+	}{
+		{"", Limit{}, false},
+		{"0", Limit{}, false},
+		{"10/s", Limit{Rate: 10, Burst: 10}, false},
+		{"60/m", Limit{Rate: 1, Burst: 60}, false},
+		{"3600/h", Limit{Rate: 1, Burst: 3600}, false},
+		{"10", Limit{}, true},
+		{"10/d", Limit{}, true},
+		{"0/s", Limit{}, true},
+		{"-5/s", Limit{}, true},
+		{"ten/s", Limit{}, true},
+		{"/s", Limit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseLimit(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLimit(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseLimit(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitEnabled(t *testing.T) {
+	if (Limit{}).Enabled() {
+		t.Error("zero limit is enabled")
+	}
+	if !(Limit{Rate: 1, Burst: 1}).Enabled() {
+		t.Error("1/s limit is disabled")
+	}
+}
+
+func TestLimitWait(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 10}
+	tests := []struct {
+		name   string
+		tokens float64
+		want   float64
+		wait   time.Duration
+	}{
+		{"enough tokens", 3, 1, 0},
+		{"exactly enough", 1, 1, 0},
+		{"half a token short", 0.5, 1, 250 * time.Millisecond},
+		{"empty bucket to full", 0, 10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := limit.wait(tt.tokens, tt.want); got != tt.wait {
+				t.Fatalf("wait(%v, %v) = %s, want %s", tt.tokens, tt.want, got, tt.wait)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter applies a limit, which can be changed at runtime, to buckets of one route group.
+type Limiter struct {
+	name  string
+	store Store
+	limit atomic.Pointer[Limit]
+}
+
+func NewLimiter(name string, store Store, limit Limit) *Limiter {
+	l := &Limiter{name: name, store: store}
+	l.SetLimit(limit)
+	return l
+}
+
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+func (l *Limiter) SetLimit(limit Limit) {
+	l.limit.Store(&limit)
+}
+
+func (l *Limiter) Limit() Limit {
+	return *l.limit.Load()
+}
+
+func (l *Limiter) Take(ctx context.Context, key string) (Result, error) {
+	limit := l.Limit()
+	allowed, tokens, err := l.store.Take(ctx, l.name+":"+key, limit)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(tokens),
+		Reset:     limit.wait(tokens, float64(limit.Burst)),
+	}
+	if !allowed {
+		result.RetryAfter = limit.wait(tokens, 1)
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	cleanupPeriod = time.Minute
+	// staleAge is enough for any bucket to refill completely, since limits are at most per hour.
+	staleAge = time.Hour
+)
+
+// Store takes a token from the bucket identified by key and reports tokens left.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (bool, float64, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type MemoryStore struct {
+	mutex       sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), lastCleanup: time.Now()}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (bool, float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastCleanup) > cleanupPeriod {
+		s.cleanup(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, b.tokens, nil
+	}
+	b.tokens--
+	return true, b.tokens, nil
+}
+
+// cleanup drops buckets which have been refilled completely since their last use.
+func (s *MemoryStore) cleanup(now time.Time) {
+	s.lastCleanup = now
+	for key, b := range s.buckets {
+		if now.Sub(b.updated) > staleAge {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+type Backend interface {
+	TakeRateLimitToken(ctx context.Context, key string, rate float64, burst int) (bool, float64, error)
+	DeleteStaleRateLimits(ctx context.Context, olderThan time.Duration) error
+}
+
+// PostgresStore keeps buckets in the database so limits are shared between instances.
+type PostgresStore struct {
+	backend     Backend
+	lastCleanup atomic.Int64
+}
+
+func NewPostgresStore(backend Backend) *PostgresStore {
+	s := &PostgresStore{backend: backend}
+	s.lastCleanup.Store(time.Now().UnixNano())
+	return s
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (bool, float64, error) {
+	now := time.Now().UnixNano()
+	last := s.lastCleanup.Load()
+	if time.Duration(now-last) > cleanupPeriod && s.lastCleanup.CompareAndSwap(last, now) {
+		go func() {
+			if err := s.backend.DeleteStaleRateLimits(context.Background(), staleAge); err != nil {
+				logger.Log.Error("failed to delete stale rate limits", zap.String("error", err.Error()))
+			}
+		}()
+	}
+	return s.backend.TakeRateLimitToken(ctx, key, limit.Rate, limit.Burst)
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreBurst(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Rate: 1, Burst: 3}
+
+	for i := 0; i < limit.Burst; i++ {
+		allowed, tokens, err := store.Take(context.Background(), "key", limit)
+		if err != nil || !allowed {
+			t.Fatalf("take %d: allowed = %v, err = %v", i, allowed, err)
+		}
+		if want := float64(limit.Burst - i - 1); tokens < want || tokens > want+0.1 {
+			t.Fatalf("take %d: tokens = %v, want %v", i, tokens, want)
+		}
+	}
+	if allowed, _, _ := store.Take(context.Background(), "key", limit); allowed {
+		t.Fatal("take past burst allowed")
+	}
+	if allowed, _, _ := store.Take(context.Background(), "other", limit); !allowed {
+		t.Fatal("separate key limited")
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Rate: 2, Burst: 4}
+	store.buckets["key"] = &bucket{tokens: 0, updated: time.Now().Add(-time.Second)}
+
+	allowed, tokens, err := store.Take(context.Background(), "key", limit)
+	if err != nil || !allowed {
+		t.Fatalf("allowed = %v, err = %v after refill", allowed, err)
+	}
+	if tokens < 1 || tokens > 1.1 {
+		t.Fatalf("tokens = %v, want 1 after a second at 2/s", tokens)
+	}
+}
+
+func TestMemoryStoreRefillCappedAtBurst(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Rate: 10, Burst: 4}
+	store.buckets["key"] = &bucket{tokens: 0, updated: time.Now().Add(-time.Hour)}
+
+	_, tokens, _ := store.Take(context.Background(), "key", limit)
+	if tokens != float64(limit.Burst-1) {
+		t.Fatalf("tokens = %v, want %d", tokens, limit.Burst-1)
+	}
+}
+
+func TestMemoryStoreCleanup(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.buckets["stale"] = &bucket{updated: now.Add(-2 * staleAge)}
+	store.buckets["fresh"] = &bucket{updated: now}
+
+	store.cleanup(now)
+	if _, ok := store.buckets["stale"]; ok {
+		t.Error("stale bucket kept")
+	}
+	if _, ok := store.buckets["fresh"]; !ok {
+		t.Error("fresh bucket dropped")
+	}
+}
+
+func TestLimiterTake(t *testing.T) {
+	limiter := NewLimiter("api", NewMemoryStore(), Limit{Rate: 1, Burst: 1})
+
+	result, err := limiter.Take(context.Background(), "user")
+	if err != nil || !result.Allowed || result.Limit != 1 || result.Remaining != 0 {
+		t.Fatalf("first take = %+v, err = %v", result, err)
+	}
+	result, err = limiter.Take(context.Background(), "user")
+	if err != nil || result.Allowed {
+		t.Fatalf("second take = %+v, err = %v", result, err)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Fatalf("retry after = %s, want within a second", result.RetryAfter)
+	}
+
+	limiter.SetLimit(Limit{Rate: 1, Burst: 5})
+	if got := limiter.Limit().Burst; got != 5 {
+		t.Fatalf("burst after SetLimit = %d, want 5", got)
+	}
+}
@@ -0,0 +1,320 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (r *Database) GetUserRole(ctx context.Context, userID string) (string, error) {
+	ctx, span := startSpan(ctx, "GetUserRole")
+	defer span.End()
+
+	var role string
+	err := r.db.QueryRowContext(ctx, "SELECT COALESCE(role, 'user') FROM users WHERE userID=$1", userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user role", zap.String("error", err.Error()))
+		return "", err
+	}
+	return role, nil
+}
+
+func (r *Database) SetUserRole(ctx context.Context, actor string, login string, role string) error {
+	ctx, span := startSpan(ctx, "SetUserRole")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, "UPDATE users SET role=$1 WHERE userName=$2 RETURNING userID", role, login).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to set user role", zap.String("error", err.Error()))
+		return err
+	}
+
+	if err := insertAuditRecord(ctx, tx, actor, "user.role", userID, map[string]string{"role": role}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Database) SearchUsers(ctx context.Context, query string, limit int, offset int) ([]models.AdminUserRecord, error) {
+	ctx, span := startSpan(ctx, "SearchUsers")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, `SELECT u.userID, u.userName, COALESCE(u.role, 'user'), COALESCE(b.sum, 0), COALESCE(b.withDrawn, 0)
+		FROM users u LEFT JOIN balance b ON b.userID = u.userID
+		WHERE u.userName ILIKE $1 OR u.userID = $2 ORDER BY u.userName LIMIT $3 OFFSET $4`,
+		"%"+likeEscaper.Replace(query)+"%", query, limit, offset)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to search users", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.AdminUserRecord
+	for rows.Next() {
+		var item models.AdminUserRecord
+		if err := rows.Scan(&item.UserID, &item.Login, &item.Role, &item.Current, &item.Withdrawn); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan search users result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+// RequeueOrder resets attempts of an unprocessed order, or reopens an invalid one that never
+// accrued, and returns its owner. updated is kept so the sweeper still treats the order as stuck.
+func (r *Database) RequeueOrder(ctx context.Context, actor string, number string) (string, error) {
+	ctx, span := startSpan(ctx, "RequeueOrder")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID, status string
+	var accrual sql.NullFloat64
+	err = tx.QueryRowContext(ctx, "SELECT userID, status, accrual FROM orders WHERE number=$1 FOR UPDATE", number).Scan(&userID, &status, &accrual)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get order", zap.String("error", err.Error()))
+		return "", err
+	}
+
+	switch {
+	case status == models.OrderNew || status == models.OrderProcessing:
+		_, err = tx.ExecContext(ctx, "UPDATE orders SET attempts=0 WHERE number=$1", number)
+	case status == models.OrderInvalid && accrual.Float64 == 0:
+		// the sweeper gives up on orders the accrual system never answered for, let them be polled again
+		_, err = tx.ExecContext(ctx, "UPDATE orders SET status='NEW', attempts=0 WHERE number=$1", number)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO order_history (number, status, accrual, date) Values ($1, 'NEW', 0, current_timestamp)", number)
+		}
+	default:
+		return "", myerrors.ErrConflict
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to requeue order", zap.String("error", err.Error()))
+		return "", err
+	}
+
+	if err := insertAuditRecord(ctx, tx, actor, "order.requeue", userID, map[string]string{"number": number, "status": status}); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+const (
+	allowDebtSetting = "gofermart.allow_debt"
+	// debtGuardTolerance mirrors balanceTolerance so float rounding on a full spend is not debt.
+	debtGuardTolerance = "0.01"
+)
+
+// allowDebt lets the balance_no_debt trigger accept negative balances for the rest of the transaction.
+func allowDebt(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "SELECT set_config($1, 'on', true)", allowDebtSetting)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to allow debt", zap.String("error", err.Error()))
+	}
+	return err
+}
+
+// adjustBalance applies the signed adjustment amount to the balance, which may leave it in debt.
+func (r *Database) adjustBalance(ctx context.Context, tx *sql.Tx, rec models.AdjustmentRecord) (models.AdjustmentRecord, error) {
+	if err := allowDebt(ctx, tx); err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+
+	query := `INSERT INTO balance (userID, sum, withDrawn) Values ($1, $2, 0.0) ON CONFLICT (userID) DO UPDATE SET sum=balance.sum + EXCLUDED.sum`
+	_, err := tx.ExecContext(ctx, query, rec.UserID, rec.Amount)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to adjust balance", zap.String("error", err.Error()))
+		return models.AdjustmentRecord{}, err
+	}
+	if _, err := r.syncLots(ctx, tx, rec.UserID, nil); err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+
+	var created time.Time
+	err = tx.QueryRowContext(ctx, `INSERT INTO adjustments (userID, amount, code, orderNumber, reason, actor, date)
+		Values ($1, $2, $3, NULLIF($4, ''), $5, $6, current_timestamp) RETURNING id, date`,
+		rec.UserID, rec.Amount, rec.Code, rec.OrderNumber, rec.Reason, rec.Actor).Scan(&rec.ID, &created)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return models.AdjustmentRecord{}, myerrors.ErrExists
+		}
+		logger.FromContext(ctx).Error("Failed to insert adjustment", zap.String("error", err.Error()))
+		return models.AdjustmentRecord{}, err
+	}
+	rec.CreatedAt = created.Format(time.RFC3339)
+
+	if err := insertAuditRecord(ctx, tx, rec.Actor, "balance.adjust", rec.UserID, rec); err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+	return rec, nil
+}
+
+// checkUserExists fails with ErrNotFound when there is no such user.
+func checkUserExists(ctx context.Context, tx *sql.Tx, userID string) error {
+	var exists bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE userID=$1)", userID).Scan(&exists)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check user", zap.String("error", err.Error()))
+		return err
+	}
+	if !exists {
+		return myerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (r *Database) AdjustBalance(ctx context.Context, actor string, userID string, req models.AdjustmentRequest) (models.AdjustmentRecord, error) {
+	ctx, span := startSpan(ctx, "AdjustBalance")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return models.AdjustmentRecord{}, err
+	}
+	defer tx.Rollback()
+
+	if err := checkUserExists(ctx, tx, userID); err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+
+	rec, err := r.adjustBalance(ctx, tx, models.AdjustmentRecord{
+		UserID: userID,
+		Amount: req.Amount,
+		Code:   req.Code,
+		Reason: req.Reason,
+		Actor:  actor,
+	})
+	if err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+	return rec, tx.Commit()
+}
+
+// ReverseOrderAccrual claws back the accrual of a processed order, once per order.
+func (r *Database) ReverseOrderAccrual(ctx context.Context, actor string, number string, reason string) (models.AdjustmentRecord, error) {
+	ctx, span := startSpan(ctx, "ReverseOrderAccrual")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return models.AdjustmentRecord{}, err
+	}
+	defer tx.Rollback()
+
+	var userID, status string
+	var accrual float32
+	err = tx.QueryRowContext(ctx, "SELECT userID, status, COALESCE(accrual, 0) FROM orders WHERE number=$1 FOR UPDATE", number).Scan(&userID, &status, &accrual)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.AdjustmentRecord{}, myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get order", zap.String("error", err.Error()))
+		return models.AdjustmentRecord{}, err
+	}
+	if status != models.OrderProcessed || accrual <= 0 {
+		return models.AdjustmentRecord{}, myerrors.ErrConflict
+	}
+
+	// balance goes before lots, the order every balance change locks them in
+	_, err = tx.ExecContext(ctx, "SELECT 1 FROM balance WHERE userID=$1 FOR UPDATE", userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to lock balance", zap.String("error", err.Error()))
+		return models.AdjustmentRecord{}, err
+	}
+	if err := reverseAccrualLot(ctx, tx, number, accrual); err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+
+	rec, err := r.adjustBalance(ctx, tx, models.AdjustmentRecord{
+		UserID:      userID,
+		Amount:      -accrual,
+		Code:        models.AdjustmentOrderReversal,
+		OrderNumber: number,
+		Reason:      reason,
+		Actor:       actor,
+	})
+	if err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+	return rec, tx.Commit()
+}
+
+func (r *Database) InsertAuditRecord(ctx context.Context, actor string, action string, userID string, details any) error {
+	ctx, span := startSpan(ctx, "InsertAuditRecord")
+	defer span.End()
+
+	return insertAuditRecord(ctx, r.db, actor, action, userID, details)
+}
+
+func (r *Database) GetAuditLog(ctx context.Context, userID string, limit int) ([]models.AuditRecord, error) {
+	ctx, span := startSpan(ctx, "GetAuditLog")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, `SELECT id, actor, action, COALESCE(userID, ''), details, date FROM audit_log
+		WHERE $1 = '' OR userID = $1 ORDER BY id DESC LIMIT $2`, userID, limit)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get audit log", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.AuditRecord
+	for rows.Next() {
+		var item models.AuditRecord
+		var details string
+		var created time.Time
+		if err := rows.Scan(&item.ID, &item.Actor, &item.Action, &item.UserID, &details, &created); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan audit log result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		item.Details = []byte(details)
+		item.CreatedAt = created.Format(time.RFC3339)
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
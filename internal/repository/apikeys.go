@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+func (r *Database) CreateAPIKey(ctx context.Context, userID string, rec models.APIKeyRecord, hash string) error {
+	ctx, span := startSpan(ctx, "CreateAPIKey")
+	defer span.End()
+
+	_, err := r.db.ExecContext(ctx, "INSERT INTO api_keys (id, userID, name, prefix, hash, scopes, date) Values ($1, $2, $3, $4, $5, $6, current_timestamp)",
+		rec.ID, userID, rec.Name, rec.Prefix, hash, strings.Join(rec.Scopes, ","))
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert api key", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (r *Database) GetAPIKeys(ctx context.Context, userID string) ([]models.APIKeyRecord, error) {
+	ctx, span := startSpan(ctx, "GetAPIKeys")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT id, name, prefix, scopes, date, lastUsed FROM api_keys WHERE userID=$1 ORDER BY date", userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get api keys", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.APIKeyRecord
+	for rows.Next() {
+		var item models.APIKeyRecord
+		var scopes string
+		var created time.Time
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&item.ID, &item.Name, &item.Prefix, &scopes, &created, &lastUsed); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan get api keys result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		item.Scopes = strings.Split(scopes, ",")
+		item.CreatedAt = created.Format(time.RFC3339)
+		if lastUsed.Valid {
+			item.LastUsedAt = lastUsed.Time.Format(time.RFC3339)
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) DeleteAPIKey(ctx context.Context, userID string, id string) error {
+	ctx, span := startSpan(ctx, "DeleteAPIKey")
+	defer span.End()
+
+	res, err := r.db.ExecContext(ctx, "DELETE FROM api_keys WHERE id=$1 AND userID=$2", id, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to delete api key", zap.String("error", err.Error()))
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return myerrors.ErrNotFound
+	}
+	return nil
+}
+
+// UseAPIKey finds the key by hash and records its use, at most once a minute.
+func (r *Database) UseAPIKey(ctx context.Context, hash string) (string, []string, error) {
+	ctx, span := startSpan(ctx, "UseAPIKey")
+	defer span.End()
+
+	query := `WITH touched AS (
+		UPDATE api_keys SET lastUsed=current_timestamp
+		WHERE hash=$1 AND (lastUsed IS NULL OR lastUsed < current_timestamp - interval '1 minute'))
+		SELECT userID, scopes FROM api_keys WHERE hash=$1`
+	var userID, scopes string
+	err := r.db.QueryRowContext(ctx, query, hash).Scan(&userID, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to use api key", zap.String("error", err.Error()))
+		return "", nil, err
+	}
+	return userID, strings.Split(scopes, ","), nil
+}
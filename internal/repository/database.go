@@ -1,13 +1,19 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	myerrors "github.com/rutkin/gofermart/internal/errors"
 	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/metrics"
 	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/jackc/pgerrcode"
@@ -15,6 +21,8 @@ import (
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+const SchemaVersion = 12
+
 func NewDatabase(databaseURI string) (*Database, error) {
 	db, err := sql.Open("pgx", databaseURI)
 	if err != nil {
@@ -36,43 +44,260 @@ func NewDatabase(databaseURI string) (*Database, error) {
 		return nil, err
 	}
 
+	_, err = tx.Exec("ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) DEFAULT 'user'")
+	if err != nil {
+		logger.Log.Error("Failed to alter users table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
 	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS orders (userID VARCHAR(50), number VARCHAR (50) UNIQUE NOT NULL, status VARCHAR (50), accrual REAL, date DATE)")
 	if err != nil {
 		logger.Log.Error("Failed to create orders table", zap.String("error", err.Error()))
 		return nil, err
 	}
 
-	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS balance (userID VARCHAR(50) UNIQUE NOT NULL, sum REAL, withDrawn REAL, constraint sum_nonnegative check (sum >= 0))")
+	_, err = tx.Exec("ALTER TABLE orders ADD COLUMN IF NOT EXISTS attempts INTEGER DEFAULT 0, ADD COLUMN IF NOT EXISTS updated TIMESTAMP DEFAULT current_timestamp")
+	if err != nil {
+		logger.Log.Error("Failed to alter orders table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS order_history (number VARCHAR (50) NOT NULL, status VARCHAR (50), accrual REAL, date TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create order history table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS balance (userID VARCHAR(50) UNIQUE NOT NULL, sum REAL, withDrawn REAL)")
 	if err != nil {
 		logger.Log.Error("Failed to create balance table", zap.String("error", err.Error()))
 		return nil, err
 	}
 
+	// negative sum is a debt after clawbacks, so the plain check gives way to a trigger
+	_, err = tx.Exec("ALTER TABLE balance DROP CONSTRAINT IF EXISTS sum_nonnegative")
+	if err != nil {
+		logger.Log.Error("Failed to alter balance table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	// only transactions that called allowDebt may push a balance below zero or deeper into debt
+	_, err = tx.Exec(`CREATE OR REPLACE FUNCTION balance_no_debt() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.sum < -` + debtGuardTolerance + ` AND (TG_OP = 'INSERT' OR NEW.sum < OLD.sum)
+				AND COALESCE(current_setting('` + allowDebtSetting + `', true), '') <> 'on' THEN
+				RAISE EXCEPTION 'balance of % would become negative', NEW.userID USING ERRCODE = 'check_violation';
+			END IF;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql`)
+	if err != nil {
+		logger.Log.Error("Failed to create balance debt function", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("DROP TRIGGER IF EXISTS balance_no_debt ON balance")
+	if err != nil {
+		logger.Log.Error("Failed to drop balance debt trigger", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TRIGGER balance_no_debt BEFORE INSERT OR UPDATE OF sum ON balance FOR EACH ROW EXECUTE FUNCTION balance_no_debt()")
+	if err != nil {
+		logger.Log.Error("Failed to create balance debt trigger", zap.String("error", err.Error()))
+		return nil, err
+	}
+
 	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS withdrawals (userID VARCHAR(50), number VARCHAR (50), sum REAL, date DATE)")
 	if err != nil {
 		logger.Log.Error("Failed to create withdrawals table", zap.String("error", err.Error()))
 		return nil, err
 	}
 
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS webhooks (id VARCHAR(50) UNIQUE NOT NULL, userID VARCHAR(50), url VARCHAR (500) NOT NULL, secret VARCHAR (100) NOT NULL, events VARCHAR (200), date TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create webhooks table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS webhook_deliveries (id SERIAL PRIMARY KEY, webhookID VARCHAR(50), userID VARCHAR(50), event VARCHAR (50), payload TEXT, status VARCHAR (20), attempts INTEGER, nextAttempt TIMESTAMP, lastError TEXT, date TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create webhook deliveries table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS audit_log (id SERIAL PRIMARY KEY, actor VARCHAR(50), action VARCHAR(50), userID VARCHAR(50), details TEXT, date TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create audit log table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS rate_limits (key VARCHAR(200) PRIMARY KEY, tokens DOUBLE PRECISION, allowed BOOLEAN, updated TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create rate limits table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS api_keys (id VARCHAR(50) PRIMARY KEY, userID VARCHAR(50), name VARCHAR(100), prefix VARCHAR(20), hash VARCHAR(100) UNIQUE, scopes TEXT, date TIMESTAMP, lastUsed TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create api keys table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS adjustments (id SERIAL PRIMARY KEY, userID VARCHAR(50), amount REAL, reason TEXT, actor VARCHAR(50), date TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create adjustments table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("ALTER TABLE adjustments ADD COLUMN IF NOT EXISTS code VARCHAR(30) DEFAULT 'correction', ADD COLUMN IF NOT EXISTS orderNumber VARCHAR(50)")
+	if err != nil {
+		logger.Log.Error("Failed to alter adjustments table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS adjustments_order_reversal ON adjustments (orderNumber) WHERE code = 'order_reversal'")
+	if err != nil {
+		logger.Log.Error("Failed to create adjustments index", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS id SERIAL, ADD COLUMN IF NOT EXISTS refunded REAL DEFAULT 0")
+	if err != nil {
+		logger.Log.Error("Failed to alter withdrawals table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS refunds (id SERIAL PRIMARY KEY, withdrawalID INTEGER NOT NULL, userID VARCHAR(50), amount REAL, reason TEXT, actor VARCHAR(50), date TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create refunds table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS holds (id SERIAL PRIMARY KEY, userID VARCHAR(50) NOT NULL, number VARCHAR(50), sum REAL, status VARCHAR(20), withdrawalID INTEGER, created TIMESTAMP, expires TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create holds table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS holds_active ON holds (userID, expires) WHERE status = 'active'")
+	if err != nil {
+		logger.Log.Error("Failed to create holds index", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS transfers (id SERIAL PRIMARY KEY, fromUserID VARCHAR(50) NOT NULL, toUserID VARCHAR(50) NOT NULL, amount REAL, idempotencyKey VARCHAR(100) NOT NULL, date TIMESTAMP, UNIQUE (fromUserID, idempotencyKey))")
+	if err != nil {
+		logger.Log.Error("Failed to create transfers table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS transfers_to ON transfers (toUserID)")
+	if err != nil {
+		logger.Log.Error("Failed to create transfers index", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS lots (id SERIAL PRIMARY KEY, userID VARCHAR(50) NOT NULL, amount REAL, remaining REAL, expired REAL DEFAULT 0, created TIMESTAMP, expires TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create lots table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS lots_remaining ON lots (userID, expires) WHERE remaining > 0")
+	if err != nil {
+		logger.Log.Error("Failed to create lots index", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS withdrawal_lots (id SERIAL PRIMARY KEY, withdrawalID INTEGER NOT NULL, amount REAL, expires TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create withdrawal lots table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS withdrawal_lots_withdrawal ON withdrawal_lots (withdrawalID)")
+	if err != nil {
+		logger.Log.Error("Failed to create withdrawal lots index", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("ALTER TABLE lots ADD COLUMN IF NOT EXISTS availableAt TIMESTAMP, ADD COLUMN IF NOT EXISTS number VARCHAR(50)")
+	if err != nil {
+		logger.Log.Error("Failed to alter lots table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS lots_number ON lots (number) WHERE number IS NOT NULL")
+	if err != nil {
+		logger.Log.Error("Failed to create lots number index", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, date TIMESTAMP)")
+	if err != nil {
+		logger.Log.Error("Failed to create schema migrations table", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, date) Values ($1, current_timestamp) ON CONFLICT (version) DO NOTHING", SchemaVersion)
+	if err != nil {
+		logger.Log.Error("Failed to record schema version", zap.String("error", err.Error()))
+		return nil, err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		logger.Log.Error("Failed to prepare db", zap.String("error", err.Error()))
 		return nil, err
 	}
 
-	return &Database{db}, nil
+	metrics.RegisterDB(db)
+	return &Database{db: db}, nil
 }
 
 type Database struct {
-	db *sql.DB
+	db            *sql.DB
+	pointsTTL     time.Duration
+	expiryNotice  time.Duration
+	pendingPeriod time.Duration
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracing.Tracer.Start(ctx, "Database."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql")))
 }
 
-func (r *Database) CreateUser(name string, password string) (string, error) {
+func (r *Database) Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "Ping")
+	defer span.End()
+
+	return r.db.PingContext(ctx)
+}
+
+func (r *Database) GetSchemaVersion(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "GetSchemaVersion")
+	defer span.End()
+
+	var version int
+	err := r.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get schema version", zap.String("error", err.Error()))
+		return 0, err
+	}
+	return version, nil
+}
+
+func (r *Database) CreateUser(ctx context.Context, name string, password string) (string, error) {
+	ctx, span := startSpan(ctx, "CreateUser")
+	defer span.End()
+
 	userID := uuid.New().String()
-	_, err := r.db.Exec("INSERT INTO users (userID, userName, password) Values ($1, $2, $3)", userID, name, password)
+	_, err := r.db.ExecContext(ctx, "INSERT INTO users (userID, userName, password) Values ($1, $2, $3)", userID, name, password)
 
 	if err != nil {
-		logger.Log.Error("Failed to insert user", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to insert user", zap.String("error", err.Error()))
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) {
 			err = myerrors.ErrExists
@@ -83,9 +308,12 @@ func (r *Database) CreateUser(name string, password string) (string, error) {
 	return userID, nil
 }
 
-func (r *Database) GetUserID(name string, password string) (string, error) {
+func (r *Database) GetUserID(ctx context.Context, name string, password string) (string, error) {
+	ctx, span := startSpan(ctx, "GetUserID")
+	defer span.End()
+
 	var userID string
-	err := r.db.QueryRow("SELECT userID FROM users WHERE userName=$1 AND password=$2", name, password).Scan(&userID)
+	err := r.db.QueryRowContext(ctx, "SELECT userID FROM users WHERE userName=$1 AND password=$2", name, password).Scan(&userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return "", myerrors.ErrNotFound
@@ -95,29 +323,32 @@ func (r *Database) GetUserID(name string, password string) (string, error) {
 	return userID, nil
 }
 
-func (r *Database) CreateOrder(userID string, number string) error {
-	tx, err := r.db.Begin()
+func (r *Database) CreateOrder(ctx context.Context, userID string, number string) error {
+	ctx, span := startSpan(ctx, "CreateOrder")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		logger.Log.Error("Failed to create transaction", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
 		return err
 	}
 	defer tx.Rollback()
 
-	rows, err := tx.Query("SELECT userID FROM orders WHERE number=$1;", number)
+	rows, err := tx.QueryContext(ctx, "SELECT userID FROM orders WHERE number=$1;", number)
 	if err != nil {
-		logger.Log.Error("failed to select user from order", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("failed to select user from order", zap.String("error", err.Error()))
 		return err
 	}
 	if rows.Next() {
 		err = rows.Err()
 		if err != nil {
-			logger.Log.Error("Failed to iterate db", zap.String("error", err.Error()))
+			logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
 			return err
 		}
 		var currentUserID string
 		err = rows.Scan(&currentUserID)
 		if err != nil {
-			logger.Log.Error("Failed to scan value", zap.String("error", err.Error()))
+			logger.FromContext(ctx).Error("Failed to scan value", zap.String("error", err.Error()))
 			return err
 		}
 
@@ -126,35 +357,181 @@ func (r *Database) CreateOrder(userID string, number string) error {
 		}
 		return myerrors.ErrExists
 	}
-	_, err = tx.Exec("INSERT INTO orders (userID, number, status, accrual, date) Values ($1, $2, 'NEW', 0, current_timestamp)", userID, number)
+	_, err = tx.ExecContext(ctx, "INSERT INTO orders (userID, number, status, accrual, date) Values ($1, $2, 'NEW', 0, current_timestamp)", userID, number)
 	if err != nil {
-		logger.Log.Error("failed to insert order", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("failed to insert order", zap.String("error", err.Error()))
 		return err
 	}
-	logger.Log.Info("create order", zap.String("number", number))
+	_, err = tx.ExecContext(ctx, "INSERT INTO order_history (number, status, accrual, date) Values ($1, 'NEW', 0, current_timestamp)", number)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to insert order history", zap.String("error", err.Error()))
+		return err
+	}
+	logger.FromContext(ctx).Info("create order", zap.String("number", number))
 	tx.Commit()
 	return nil
 }
 
-func (r *Database) GetOrder(number string) (models.OrderRecord, error) {
-	logger.Log.Info("get order", zap.String("number", number))
+func (r *Database) CreateOrders(ctx context.Context, userID string, numbers []string) (map[string]error, error) {
+	ctx, span := startSpan(ctx, "CreateOrders")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO orders (userID, number, status, accrual, date) SELECT $1, unnest($2::varchar[]), 'NEW', 0, current_timestamp ON CONFLICT (number) DO NOTHING RETURNING number`
+	rows, err := tx.QueryContext(ctx, query, userID, numbers)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to insert orders", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	result := make(map[string]error, len(numbers))
+	var inserted []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			rows.Close()
+			logger.FromContext(ctx).Error("Failed to scan inserted orders", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result[number] = nil
+		inserted = append(inserted, number)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO order_history (number, status, accrual, date) SELECT unnest($1::varchar[]), 'NEW', 0, current_timestamp", inserted)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to insert orders history", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	var existing []string
+	for _, number := range numbers {
+		if _, ok := result[number]; !ok {
+			existing = append(existing, number)
+		}
+	}
+
+	if len(existing) > 0 {
+		rows, err = tx.QueryContext(ctx, "SELECT number, userID FROM orders WHERE number = ANY($1);", existing)
+		if err != nil {
+			logger.FromContext(ctx).Error("failed to select users from orders", zap.String("error", err.Error()))
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var number, currentUserID string
+			if err := rows.Scan(&number, &currentUserID); err != nil {
+				logger.FromContext(ctx).Error("Failed to scan value", zap.String("error", err.Error()))
+				return nil, err
+			}
+			if currentUserID != userID {
+				result[number] = myerrors.ErrConflict
+			} else {
+				result[number] = myerrors.ErrExists
+			}
+		}
+		if err := rows.Err(); err != nil {
+			logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+			return nil, err
+		}
+	}
+
+	logger.FromContext(ctx).Info("create orders", zap.Int("count", len(inserted)))
+	return result, tx.Commit()
+}
+
+func (r *Database) GetOrder(ctx context.Context, userID string, number string) (models.OrderRecord, error) {
+	ctx, span := startSpan(ctx, "GetOrder")
+	defer span.End()
+
+	logger.FromContext(ctx).Info("get order", zap.String("number", number))
 	var result models.OrderRecord
-	err := r.db.QueryRow("SELECT number, status, accrual, date FROM orders WHERE number=$1;", number).Scan(&result.Number, &result.Status, &result.Accrual, &result.UploadetAt)
+	err := r.db.QueryRowContext(ctx, "SELECT number, status, accrual, date FROM orders WHERE userID=$1 AND number=$2;", userID, number).Scan(&result.Number, &result.Status, &result.Accrual, &result.UploadetAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return models.OrderRecord{}, myerrors.ErrInvalid
+			return models.OrderRecord{}, myerrors.ErrNotFound
 		}
-		logger.Log.Error("Failed to get order from db", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to get order from db", zap.String("error", err.Error()))
 		return models.OrderRecord{}, err
 	}
 
 	return result, nil
 }
 
-func (r *Database) GetOrders(userID string) (models.OrdersResponse, error) {
-	rows, err := r.db.Query("SELECT number, status, accrual, date FROM orders WHERE userID=$1;", userID)
+func (r *Database) GetOrderHistory(ctx context.Context, number string) ([]models.OrderHistoryRecord, error) {
+	ctx, span := startSpan(ctx, "GetOrderHistory")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT status, accrual, date FROM order_history WHERE number=$1 ORDER BY date;", number)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get order history from db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []models.OrderHistoryRecord{}
+	for rows.Next() {
+		var record models.OrderHistoryRecord
+		if err := rows.Scan(&record.Status, &record.Accrual, &record.Date); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan order history result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	err = rows.Err()
 	if err != nil {
-		logger.Log.Error("Failed to get orders from db", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) GetOrdersStatus(ctx context.Context, userID string, numbers []string) ([]models.OrderRecord, error) {
+	ctx, span := startSpan(ctx, "GetOrdersStatus")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT number, status, accrual, date FROM orders WHERE userID=$1 AND number = ANY($2);", userID, numbers)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get orders status from db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.OrderRecord
+	for rows.Next() {
+		var record models.OrderRecord
+		if err := rows.Scan(&record.Number, &record.Status, &record.Accrual, &record.UploadetAt); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan orders status result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	err = rows.Err()
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) GetOrders(ctx context.Context, userID string) (models.OrdersResponse, error) {
+	ctx, span := startSpan(ctx, "GetOrders")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT number, status, accrual, date FROM orders WHERE userID=$1;", userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get orders from db", zap.String("error", err.Error()))
 		return nil, err
 	}
 
@@ -162,12 +539,12 @@ func (r *Database) GetOrders(userID string) (models.OrdersResponse, error) {
 	for rows.Next() {
 		err := rows.Err()
 		if err != nil {
-			logger.Log.Error("Failed to iterate db", zap.String("error", err.Error()))
+			logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
 			return nil, err
 		}
 		var record models.OrderRecord
 		if err := rows.Scan(&record.Number, &record.Status, &record.Accrual, &record.UploadetAt); err != nil {
-			logger.Log.Error("Failed to scan get urls result", zap.String("error", err.Error()))
+			logger.FromContext(ctx).Error("Failed to scan get urls result", zap.String("error", err.Error()))
 			return nil, err
 		}
 		result = append(result, record)
@@ -175,71 +552,228 @@ func (r *Database) GetOrders(userID string) (models.OrdersResponse, error) {
 	return result, nil
 }
 
-func (r *Database) UpdateOrder(userID string, number string, status string, accrual float32) error {
-	tx, err := r.db.Begin()
+func (r *Database) GetOrderState(ctx context.Context, number string) (string, string, error) {
+	ctx, span := startSpan(ctx, "GetOrderState")
+	defer span.End()
+
+	var userID, status string
+	err := r.db.QueryRowContext(ctx, "SELECT userID, status FROM orders WHERE number=$1;", number).Scan(&userID, &status)
 	if err != nil {
-		logger.Log.Error("Failed to create transaction", zap.String("error", err.Error()))
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", myerrors.ErrNotFound
+		}
+		logger.FromContext(ctx).Error("Failed to get order state from db", zap.String("error", err.Error()))
+		return "", "", err
+	}
+	return userID, status, nil
+}
+
+func (r *Database) GetUnprocessedOrders(ctx context.Context, olderThan time.Duration, limit int) ([]models.OrderTaskRecord, error) {
+	ctx, span := startSpan(ctx, "GetUnprocessedOrders")
+	defer span.End()
+
+	query := `SELECT userID, number, attempts FROM orders WHERE status IN ('NEW', 'PROCESSING')
+		AND updated <= current_timestamp - make_interval(secs => $1) ORDER BY updated LIMIT $2`
+	rows, err := r.db.QueryContext(ctx, query, olderThan.Seconds(), limit)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get unprocessed orders from db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.OrderTaskRecord
+	for rows.Next() {
+		var record models.OrderTaskRecord
+		if err := rows.Scan(&record.UserID, &record.Number, &record.Attempts); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan unprocessed orders result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) IncrementOrderAttempts(ctx context.Context, number string) error {
+	ctx, span := startSpan(ctx, "IncrementOrderAttempts")
+	defer span.End()
+
+	_, err := r.db.ExecContext(ctx, "UPDATE orders SET attempts=attempts+1, updated=current_timestamp WHERE number=$1", number)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to increment order attempts", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (r *Database) UpdateOrder(ctx context.Context, userID string, number string, fromStatus string, status string, accrual float32) error {
+	ctx, span := startSpan(ctx, "UpdateOrder")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
 		return err
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec("UPDATE orders SET status=$1, accrual=$2 WHERE number=$3", status, accrual, number)
+	res, err := tx.ExecContext(ctx, "UPDATE orders SET status=$1, accrual=$2, updated=current_timestamp WHERE number=$3 AND status=$4", status, accrual, number, fromStatus)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to delete urls from db", zap.String("error", err.Error()))
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return myerrors.ErrConflict
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO order_history (number, status, accrual, date) Values ($1, $2, $3, current_timestamp)", number, status, accrual)
 	if err != nil {
-		logger.Log.Error("Failed to delete urls from db", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to insert order history", zap.String("error", err.Error()))
 		return err
 	}
 
+	var credit float32
+	if status == models.OrderProcessed {
+		credit = accrual
+	}
 	query := `INSERT INTO balance (userID, sum, withDrawn) Values ($1, $2, 0.0) ON CONFLICT (userID) DO UPDATE SET sum=balance.sum + EXCLUDED.sum`
-	_, err = tx.Exec(query, userID, accrual)
+	_, err = tx.ExecContext(ctx, query, userID, credit)
 	if err != nil {
-		logger.Log.Error("Failed to update balance", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to update balance", zap.String("error", err.Error()))
 		return err
 	}
+	if credit > 0 {
+		part, err := r.accrualLot(ctx, tx, number, credit)
+		if err != nil {
+			return err
+		}
+		if _, err := r.syncLots(ctx, tx, userID, []lotPart{part}); err != nil {
+			return err
+		}
+	}
+
+	if status == models.OrderProcessed {
+		order := models.OrderStatusRecord{Number: number, Status: status, Accrual: accrual}
+		if err := insertWebhookEvent(ctx, tx, userID, models.WebhookOrderProcessed, order); err != nil {
+			return err
+		}
+	}
 
 	return tx.Commit()
 }
 
-func (r *Database) GetBalance(userID string) (models.BalanceRecord, error) {
+func (r *Database) CountOrdersByStatus(ctx context.Context) (map[string]int, error) {
+	ctx, span := startSpan(ctx, "CountOrdersByStatus")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT status, COUNT(*) FROM orders GROUP BY status")
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to count orders", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan orders count", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) GetTotalLiability(ctx context.Context) (float64, error) {
+	ctx, span := startSpan(ctx, "GetTotalLiability")
+	defer span.End()
+
+	var result float64
+	err := r.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(sum), 0) FROM balance").Scan(&result)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get total liability", zap.String("error", err.Error()))
+		return 0, err
+	}
+	return result, nil
+}
+
+func (r *Database) GetBalance(ctx context.Context, userID string) (models.BalanceRecord, error) {
+	ctx, span := startSpan(ctx, "GetBalance")
+	defer span.End()
+
 	var result models.BalanceRecord
-	err := r.db.QueryRow("SELECT sum, withDrawn FROM balance WHERE userID=$1", userID).Scan(&result.Current, &result.Withdrawn)
+	err := r.db.QueryRowContext(ctx, "SELECT sum, withDrawn, "+heldQuery+" FROM balance WHERE userID=$1", userID).
+		Scan(&result.Current, &result.Withdrawn, &result.Held)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, nil
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get balance", zap.String("error", err.Error()))
+		return models.BalanceRecord{}, err
+	}
+	result.Current -= result.Held
+	result.Pending, err = r.pendingPoints(ctx, r.db, userID)
+	if err != nil {
+		return models.BalanceRecord{}, err
+	}
+	result.Available = result.Current - result.Pending
+
+	result.Expiring, err = r.getExpiringPoints(ctx, userID)
 	if err != nil {
-		logger.Log.Error("Failed to get balance", zap.String("error", err.Error()))
 		return models.BalanceRecord{}, err
 	}
 	return result, nil
 }
 
-func (r *Database) Withdraw(userID string, rec models.WithdrawRecord) error {
-	tx, err := r.db.Begin()
+func (r *Database) Withdraw(ctx context.Context, userID string, rec models.WithdrawRecord) error {
+	ctx, span := startSpan(ctx, "Withdraw")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		logger.Log.Error("Failed to create transaction", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
 		return err
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec("UPDATE balance SET sum=sum-$1, withDrawn=withDrawn+$1 WHERE userID=$2", rec.Sum, userID)
+	current, reserved, err := r.lockBalance(ctx, tx, userID)
 	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) && pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) {
-			return myerrors.ErrNotEnoughtMoney
-		}
-		logger.Log.Error("Failed to update balance", zap.String("error", err.Error()))
 		return err
 	}
+	if current < 0 {
+		return myerrors.ErrDebt
+	}
+	if current-reserved < rec.Sum {
+		return myerrors.ErrNotEnoughtMoney
+	}
 
-	_, err = tx.Exec("INSERT INTO withdrawals (userID, number, sum, date) Values ($1, $2, $3, current_timestamp)", userID, rec.Number, rec.Sum)
+	id, err := insertWithdrawal(ctx, tx, userID, rec)
 	if err != nil {
-		logger.Log.Error("Failed to insert into withdrawals", zap.String("error", err.Error()))
+		return err
+	}
+	if err := r.spendLots(ctx, tx, userID, id); err != nil {
 		return err
 	}
 
 	return tx.Commit()
 }
 
-func (r *Database) GetWithdrawals(userID string) ([]models.WithdrawalResponse, error) {
-	rows, err := r.db.Query("SELECT number, sum, date FROM withdrawals WHERE userID=$1", userID)
+func (r *Database) GetWithdrawals(ctx context.Context, userID string) ([]models.WithdrawalResponse, error) {
+	ctx, span := startSpan(ctx, "GetWithdrawals")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT id, number, sum, COALESCE(refunded, 0), date FROM withdrawals WHERE userID=$1 ORDER BY id", userID)
 	if err != nil {
-		logger.Log.Error("Failed to get withdrawals", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("Failed to get withdrawals", zap.String("error", err.Error()))
 		return []models.WithdrawalResponse{}, err
 	}
 
@@ -248,14 +782,15 @@ func (r *Database) GetWithdrawals(userID string) ([]models.WithdrawalResponse, e
 	for rows.Next() {
 		err := rows.Err()
 		if err != nil {
-			logger.Log.Error("Failed to iterate db", zap.String("error", err.Error()))
+			logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
 			return nil, err
 		}
 		var item models.WithdrawalResponse
-		if err := rows.Scan(&item.Number, &item.Sum, &item.ProcessedAt); err != nil {
-			logger.Log.Error("Failed to scan get withdrawals result", zap.String("error", err.Error()))
+		if err := rows.Scan(&item.ID, &item.Number, &item.Sum, &item.Refunded, &item.ProcessedAt); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan get withdrawals result", zap.String("error", err.Error()))
 			return nil, err
 		}
+		item.Status = withdrawalStatus(item.Sum, item.Refunded)
 		result = append(result, item)
 	}
 	return result, nil
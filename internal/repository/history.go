@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+// balanceHistoryQuery lists every balance change of the user with signed amounts, newest first.
+// Entry types come in as $3..$8 in the order of historyTypes.
+const balanceHistoryQuery = `SELECT type, amount, number, code, reason, login, date FROM (
+		SELECT $3::text AS type, accrual AS amount, number, '' AS code, '' AS reason, '' AS login, updated AS date
+		FROM orders WHERE userID=$1 AND status='PROCESSED' AND accrual > 0
+		UNION ALL
+		SELECT $4::text, -sum, number, '', '', '', date::timestamp FROM withdrawals WHERE userID=$1
+		UNION ALL
+		SELECT $5::text, rf.amount, w.number, '', COALESCE(rf.reason, ''), '', rf.date
+		FROM refunds rf JOIN withdrawals w ON w.id = rf.withdrawalID WHERE rf.userID=$1
+		UNION ALL
+		SELECT $6::text, amount, COALESCE(orderNumber, ''), COALESCE(code, 'correction'), COALESCE(reason, ''), '', date
+		FROM adjustments WHERE userID=$1
+		UNION ALL
+		SELECT $7::text, -t.amount, '', '', '', u.userName, t.date
+		FROM transfers t JOIN users u ON u.userID = t.toUserID WHERE t.fromUserID=$1
+		UNION ALL
+		SELECT $7::text, t.amount, '', '', '', u.userName, t.date
+		FROM transfers t JOIN users u ON u.userID = t.fromUserID WHERE t.toUserID=$1
+		UNION ALL
+		SELECT $8::text, -expired, '', '', '', '', expires FROM lots WHERE userID=$1 AND expired > 0
+	) history ORDER BY date DESC LIMIT $2`
+
+var historyTypes = []any{
+	models.HistoryAccrual,
+	models.HistoryWithdrawal,
+	models.HistoryRefund,
+	models.HistoryAdjustment,
+	models.HistoryTransfer,
+	models.HistoryExpiration,
+}
+
+func (r *Database) GetBalanceHistory(ctx context.Context, userID string, limit int) ([]models.BalanceHistoryRecord, error) {
+	ctx, span := startSpan(ctx, "GetBalanceHistory")
+	defer span.End()
+
+	args := append([]any{userID, limit}, historyTypes...)
+	rows, err := r.db.QueryContext(ctx, balanceHistoryQuery, args...)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get balance history", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.BalanceHistoryRecord
+	for rows.Next() {
+		var item models.BalanceHistoryRecord
+		var created time.Time
+		if err := rows.Scan(&item.Type, &item.Amount, &item.Order, &item.Code, &item.Reason, &item.Login, &created); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan balance history result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		item.CreatedAt = created.Format(time.RFC3339)
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
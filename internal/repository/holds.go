@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+// heldQuery sums active holds of the balance row user, holds past their expiry no longer count.
+const heldQuery = `COALESCE((SELECT SUM(h.sum) FROM holds h
+	WHERE h.userID = balance.userID AND h.status = 'active' AND h.expires > current_timestamp), 0)`
+
+// holdStatusQuery reports active holds past their expiry as expired before the expiry job marks them.
+const holdStatusQuery = `CASE WHEN status = 'active' AND expires <= current_timestamp THEN 'expired' ELSE status END`
+
+// lockBalance locks the balance row of the user and returns its sum and the part of it that can not
+// be spent yet, either held or pending.
+func (r *Database) lockBalance(ctx context.Context, tx *sql.Tx, userID string) (float32, float32, error) {
+	var current, held float32
+	err := tx.QueryRowContext(ctx, "SELECT sum, "+heldQuery+" FROM balance WHERE userID=$1 FOR UPDATE", userID).Scan(&current, &held)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, myerrors.ErrNotEnoughtMoney
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get balance", zap.String("error", err.Error()))
+		return 0, 0, err
+	}
+
+	pending, err := r.pendingPoints(ctx, tx, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return current, held + pending, nil
+}
+
+// insertWithdrawal moves rec.Sum from the locked balance to withdrawn and records the withdrawal.
+func insertWithdrawal(ctx context.Context, tx *sql.Tx, userID string, rec models.WithdrawRecord) (int64, error) {
+	_, err := tx.ExecContext(ctx, "UPDATE balance SET sum=sum-$1, withDrawn=withDrawn+$1 WHERE userID=$2", rec.Sum, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to update balance", zap.String("error", err.Error()))
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO withdrawals (userID, number, sum, date) Values ($1, $2, $3, current_timestamp) RETURNING id", userID, rec.Number, rec.Sum).Scan(&id)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert into withdrawals", zap.String("error", err.Error()))
+		return 0, err
+	}
+
+	if err := insertWebhookEvent(ctx, tx, userID, models.WebhookWithdrawalCreated, rec); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanHold(row rowScanner) (models.HoldRecord, error) {
+	var item models.HoldRecord
+	var withdrawalID sql.NullInt64
+	var created, expires time.Time
+	if err := row.Scan(&item.ID, &item.Number, &item.Sum, &item.Status, &withdrawalID, &created, &expires); err != nil {
+		return models.HoldRecord{}, err
+	}
+	item.WithdrawalID = withdrawalID.Int64
+	item.CreatedAt = created.Format(time.RFC3339)
+	item.ExpiresAt = expires.Format(time.RFC3339)
+	return item, nil
+}
+
+const holdColumns = "id, number, sum, " + holdStatusQuery + ", withdrawalID, created, expires"
+
+// CreateHold reserves rec.Sum of the available balance until ttl passes.
+func (r *Database) CreateHold(ctx context.Context, userID string, rec models.WithdrawRecord, ttl time.Duration) (models.HoldRecord, error) {
+	ctx, span := startSpan(ctx, "CreateHold")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return models.HoldRecord{}, err
+	}
+	defer tx.Rollback()
+
+	current, reserved, err := r.lockBalance(ctx, tx, userID)
+	if err != nil {
+		return models.HoldRecord{}, err
+	}
+	if current < 0 {
+		return models.HoldRecord{}, myerrors.ErrDebt
+	}
+	if current-reserved < rec.Sum {
+		return models.HoldRecord{}, myerrors.ErrNotEnoughtMoney
+	}
+
+	query := `INSERT INTO holds (userID, number, sum, status, created, expires)
+		Values ($1, $2, $3, 'active', current_timestamp, current_timestamp + $4 * interval '1 millisecond') RETURNING ` + holdColumns
+	hold, err := scanHold(tx.QueryRowContext(ctx, query, userID, rec.Number, rec.Sum, ttl.Milliseconds()))
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert hold", zap.String("error", err.Error()))
+		return models.HoldRecord{}, err
+	}
+	return hold, tx.Commit()
+}
+
+func (r *Database) GetHolds(ctx context.Context, userID string, limit int) ([]models.HoldRecord, error) {
+	ctx, span := startSpan(ctx, "GetHolds")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT "+holdColumns+" FROM holds WHERE userID=$1 ORDER BY id DESC LIMIT $2", userID, limit)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get holds", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.HoldRecord
+	for rows.Next() {
+		item, err := scanHold(rows)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to scan holds result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+// lockActiveHold locks the hold of the user, failing with ErrConflict unless it is still active.
+func lockActiveHold(ctx context.Context, tx *sql.Tx, userID string, id int64) (models.HoldRecord, error) {
+	hold, err := scanHold(tx.QueryRowContext(ctx, "SELECT "+holdColumns+" FROM holds WHERE id=$1 AND userID=$2 FOR UPDATE", id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.HoldRecord{}, myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get hold", zap.String("error", err.Error()))
+		return models.HoldRecord{}, err
+	}
+	if hold.Status != models.HoldActive {
+		return models.HoldRecord{}, myerrors.ErrConflict
+	}
+	return hold, nil
+}
+
+// CaptureHold turns an active hold into a withdrawal of the held sum.
+func (r *Database) CaptureHold(ctx context.Context, userID string, id int64) (models.HoldRecord, error) {
+	ctx, span := startSpan(ctx, "CaptureHold")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return models.HoldRecord{}, err
+	}
+	defer tx.Rollback()
+
+	// balance goes first, the same order withdrawals and new holds lock in
+	current, reserved, err := r.lockBalance(ctx, tx, userID)
+	if err != nil && !errors.Is(err, myerrors.ErrNotEnoughtMoney) {
+		return models.HoldRecord{}, err
+	}
+	hold, err := lockActiveHold(ctx, tx, userID, id)
+	if err != nil {
+		return models.HoldRecord{}, err
+	}
+	if current < 0 {
+		return models.HoldRecord{}, myerrors.ErrDebt
+	}
+	// the hold may spend its own reservation but not what other holds or pending points cover
+	if current-(reserved-hold.Sum) < hold.Sum {
+		return models.HoldRecord{}, myerrors.ErrNotEnoughtMoney
+	}
+
+	hold.WithdrawalID, err = insertWithdrawal(ctx, tx, userID, models.WithdrawRecord{Number: hold.Number, Sum: hold.Sum})
+	if err != nil {
+		return models.HoldRecord{}, err
+	}
+	if err := r.spendLots(ctx, tx, userID, hold.WithdrawalID); err != nil {
+		return models.HoldRecord{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE holds SET status='captured', withdrawalID=$1 WHERE id=$2", hold.WithdrawalID, id)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to capture hold", zap.String("error", err.Error()))
+		return models.HoldRecord{}, err
+	}
+	hold.Status = models.HoldCaptured
+	return hold, tx.Commit()
+}
+
+// ReleaseHold returns the held sum of an active hold to the available balance.
+func (r *Database) ReleaseHold(ctx context.Context, userID string, id int64) (models.HoldRecord, error) {
+	ctx, span := startSpan(ctx, "ReleaseHold")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return models.HoldRecord{}, err
+	}
+	defer tx.Rollback()
+
+	hold, err := lockActiveHold(ctx, tx, userID, id)
+	if err != nil {
+		return models.HoldRecord{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE holds SET status='released' WHERE id=$1", id)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to release hold", zap.String("error", err.Error()))
+		return models.HoldRecord{}, err
+	}
+	hold.Status = models.HoldReleased
+	return hold, tx.Commit()
+}
+
+// ExpireHolds marks active holds past their expiry as expired and returns the affected users.
+func (r *Database) ExpireHolds(ctx context.Context) ([]string, error) {
+	ctx, span := startSpan(ctx, "ExpireHolds")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "UPDATE holds SET status='expired' WHERE status='active' AND expires <= current_timestamp RETURNING userID")
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to expire holds", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]struct{})
+	var result []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan expired holds", zap.String("error", err.Error()))
+			return nil, err
+		}
+		if _, ok := seen[userID]; !ok {
+			seen[userID] = struct{}{}
+			result = append(result, userID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,429 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+const legacyLotsBatch = 100
+
+// SetPendingPeriod sets how long accruals of processed orders stay pending before they can be spent.
+func (r *Database) SetPendingPeriod(period time.Duration) {
+	r.pendingPeriod = period
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// pendingPoints sums remaining points of the user lots still in the cooling-off period.
+func (r *Database) pendingPoints(ctx context.Context, q queryRower, userID string) (float32, error) {
+	var pending float32
+	err := q.QueryRowContext(ctx, "SELECT COALESCE(SUM(remaining), 0) FROM lots WHERE userID=$1 AND remaining > 0 AND availableAt > current_timestamp", userID).
+		Scan(&pending)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get pending points", zap.String("error", err.Error()))
+		return 0, err
+	}
+	return pending, nil
+}
+
+// SetPointsExpiry sets the lifetime of newly credited points and how far ahead balances report
+// upcoming expirations. Zero ttl credits points that never expire.
+func (r *Database) SetPointsExpiry(ttl time.Duration, notice time.Duration) {
+	r.pointsTTL = ttl
+	r.expiryNotice = notice
+}
+
+// lotPart is a share of a lot moved between users or back to the user, it keeps the lot expiry
+// and the time it becomes available.
+type lotPart struct {
+	amount      float32
+	expires     sql.NullTime
+	availableAt sql.NullTime
+	number      string
+}
+
+// accrualLot makes the lot for the accrual of the order, pending for the cooling-off period.
+func (r *Database) accrualLot(ctx context.Context, tx *sql.Tx, number string, accrual float32) (lotPart, error) {
+	part := lotPart{amount: accrual, number: number}
+	err := tx.QueryRowContext(ctx, `SELECT CASE WHEN $1 > 0 THEN current_timestamp + $1 * interval '1 millisecond' END,
+		CASE WHEN $2 > 0 THEN current_timestamp + $2 * interval '1 millisecond' END`,
+		r.pointsTTL.Milliseconds(), r.pendingPeriod.Milliseconds()).Scan(&part.expires, &part.availableAt)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get lot dates", zap.String("error", err.Error()))
+		return lotPart{}, err
+	}
+	return part, nil
+}
+
+// syncLots makes the remaining points of the user lots equal the non-negative balance, which
+// the caller has locked. Extra points are consumed from the lots expiring first and returned, so
+// debits spend points first-in, first-out. Missing points come from credits keeping their expiry,
+// then from a new lot with the full lifetime. Credits pay off a debt first.
+func (r *Database) syncLots(ctx context.Context, tx *sql.Tx, userID string, credits []lotPart) ([]lotPart, error) {
+	var sum, remaining float32
+	err := tx.QueryRowContext(ctx, `SELECT b.sum, COALESCE((SELECT SUM(l.remaining) FROM lots l WHERE l.userID = b.userID AND l.remaining > 0), 0)
+		FROM balance b WHERE b.userID=$1`, userID).Scan(&sum, &remaining)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get lots total", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	target := max(sum, 0)
+	if !differs(target, remaining) {
+		return nil, nil
+	}
+	if target < remaining {
+		return consumeLots(ctx, tx, userID, remaining-target)
+	}
+
+	gap := target - remaining
+	// the debt is paid off with the credits expiring first
+	credits = append([]lotPart(nil), credits...)
+	sort.SliceStable(credits, func(i, j int) bool {
+		return expiresAfter(credits[i].expires, credits[j].expires)
+	})
+	for _, credit := range credits {
+		if gap <= balanceTolerance {
+			break
+		}
+		credit.amount = min(credit.amount, gap)
+		if err := insertLot(ctx, tx, userID, credit); err != nil {
+			return nil, err
+		}
+		gap -= credit.amount
+	}
+	if gap > balanceTolerance {
+		_, err = tx.ExecContext(ctx, `INSERT INTO lots (userID, amount, remaining, created, expires)
+			Values ($1, $2, $2, current_timestamp, CASE WHEN $3 > 0 THEN current_timestamp + $3 * interval '1 millisecond' END)`,
+			userID, gap, r.pointsTTL.Milliseconds())
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to insert lot", zap.String("error", err.Error()))
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// expiresAfter orders lot expiries from the latest, lots without expiry first.
+func expiresAfter(a sql.NullTime, b sql.NullTime) bool {
+	if !a.Valid || !b.Valid {
+		return !a.Valid && b.Valid
+	}
+	return a.Time.After(b.Time)
+}
+
+func insertLot(ctx context.Context, tx *sql.Tx, userID string, part lotPart) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO lots (userID, amount, remaining, created, expires, availableAt, number)
+		Values ($1, $2, $2, current_timestamp, $3, $4, NULLIF($5, ''))`, userID, part.amount, part.expires, part.availableAt, part.number)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert lot", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func consumeLots(ctx context.Context, tx *sql.Tx, userID string, amount float32) ([]lotPart, error) {
+	// available points are spent before pending ones
+	rows, err := tx.QueryContext(ctx, `SELECT id, remaining, expires, availableAt FROM lots WHERE userID=$1 AND remaining > 0
+		ORDER BY COALESCE(availableAt <= current_timestamp, true) DESC, expires NULLS LAST, id FOR UPDATE`, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get lots", zap.String("error", err.Error()))
+		return nil, err
+	}
+	type lot struct {
+		id          int64
+		remaining   float32
+		expires     sql.NullTime
+		availableAt sql.NullTime
+	}
+	var lots []lot
+	for rows.Next() {
+		var item lot
+		if err := rows.Scan(&item.id, &item.remaining, &item.expires, &item.availableAt); err != nil {
+			rows.Close()
+			logger.FromContext(ctx).Error("Failed to scan lot", zap.String("error", err.Error()))
+			return nil, err
+		}
+		lots = append(lots, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	var consumed []lotPart
+	for _, item := range lots {
+		if amount <= 0 {
+			break
+		}
+		left := item.remaining - amount
+		if left < balanceTolerance {
+			left = 0
+		}
+		amount -= item.remaining - left
+		if _, err := tx.ExecContext(ctx, "UPDATE lots SET remaining=$1 WHERE id=$2", left, item.id); err != nil {
+			logger.FromContext(ctx).Error("Failed to consume lot", zap.String("error", err.Error()))
+			return nil, err
+		}
+		consumed = append(consumed, lotPart{amount: item.remaining - left, expires: item.expires, availableAt: item.availableAt})
+	}
+	return consumed, nil
+}
+
+// reverseAccrualLot takes back what is left of the accrual lot of the order, so a reversal does not
+// spend other points while the reversed ones stay pending. The caller locks the balance first.
+func reverseAccrualLot(ctx context.Context, tx *sql.Tx, number string, accrual float32) error {
+	_, err := tx.ExecContext(ctx, "UPDATE lots SET remaining=GREATEST(remaining-$1, 0) WHERE number=$2 AND remaining > 0", accrual, number)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to reverse accrual lot", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// spendLots consumes lots for the withdrawal and remembers their expiries for refunds.
+func (r *Database) spendLots(ctx context.Context, tx *sql.Tx, userID string, withdrawalID int64) error {
+	consumed, err := r.syncLots(ctx, tx, userID, nil)
+	if err != nil {
+		return err
+	}
+	for _, part := range consumed {
+		_, err := tx.ExecContext(ctx, "INSERT INTO withdrawal_lots (withdrawalID, amount, expires) Values ($1, $2, $3)", withdrawalID, part.amount, part.expires)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to insert withdrawal lot", zap.String("error", err.Error()))
+			return err
+		}
+	}
+	return nil
+}
+
+// refundedLots returns the lot shares of amount refunded from the withdrawal after already refunded
+// points, the ones expiring first go back first.
+func refundedLots(ctx context.Context, tx *sql.Tx, withdrawalID int64, refunded float32, amount float32) ([]lotPart, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT amount, expires FROM withdrawal_lots WHERE withdrawalID=$1 ORDER BY expires NULLS LAST, id", withdrawalID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get withdrawal lots", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []lotPart
+	for rows.Next() && amount > 0 {
+		var part lotPart
+		if err := rows.Scan(&part.amount, &part.expires); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan withdrawal lot", zap.String("error", err.Error()))
+			return nil, err
+		}
+		skipped := min(part.amount, refunded)
+		refunded -= skipped
+		part.amount = min(part.amount-skipped, amount)
+		if part.amount <= 0 {
+			continue
+		}
+		amount -= part.amount
+		result = append(result, part)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) getExpiringPoints(ctx context.Context, userID string) ([]models.ExpiringPoints, error) {
+	if r.expiryNotice <= 0 {
+		return nil, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT SUM(remaining), date_trunc('day', expires) AS day FROM lots
+		WHERE userID=$1 AND remaining > 0 AND expires <= current_timestamp + $2 * interval '1 millisecond'
+		GROUP BY day ORDER BY day`, userID, r.expiryNotice.Milliseconds())
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get expiring points", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.ExpiringPoints
+	for rows.Next() {
+		var item models.ExpiringPoints
+		var day time.Time
+		if err := rows.Scan(&item.Amount, &day); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan expiring points", zap.String("error", err.Error()))
+			return nil, err
+		}
+		item.ExpiresAt = day.Format(time.DateOnly)
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) queryUserIDs(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get users", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan user", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, userID)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+// SyncLegacyLots puts positive balances accrued before lots were tracked into lots, so they expire too.
+func (r *Database) SyncLegacyLots(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "SyncLegacyLots")
+	defer span.End()
+
+	users, err := r.queryUserIDs(ctx, `SELECT b.userID FROM balance b
+		WHERE b.sum > 0 AND NOT EXISTS (SELECT 1 FROM lots l WHERE l.userID = b.userID) LIMIT $1`, legacyLotsBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, userID := range users {
+		if err := r.inBalanceTx(ctx, userID, func(tx *sql.Tx) error {
+			_, err := r.syncLots(ctx, tx, userID, nil)
+			return err
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return len(users), nil
+}
+
+// inBalanceTx runs fn in a transaction holding the balance row lock of the user.
+func (r *Database) inBalanceTx(ctx context.Context, userID string, fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "SELECT 1 FROM balance WHERE userID=$1 FOR UPDATE", userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to lock balance", zap.String("error", err.Error()))
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExpirePoints writes off the remaining points of expired lots and returns the affected users and total.
+// Points reserved by active holds are kept, so a granted hold can still be captured. They expire on
+// a later run once the hold is released or expires.
+func (r *Database) ExpirePoints(ctx context.Context, limit int) ([]string, float32, error) {
+	ctx, span := startSpan(ctx, "ExpirePoints")
+	defer span.End()
+
+	users, err := r.queryUserIDs(ctx, `SELECT DISTINCT l.userID FROM lots l JOIN balance ON balance.userID = l.userID
+		WHERE l.remaining > 0 AND l.expires <= current_timestamp AND balance.sum - `+heldQuery+` > $2 LIMIT $1`, limit, balanceTolerance)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total float32
+	for _, userID := range users {
+		var expired float32
+		err := r.inBalanceTx(ctx, userID, func(tx *sql.Tx) error {
+			var sum, held float32
+			err := tx.QueryRowContext(ctx, "SELECT sum, "+heldQuery+" FROM balance WHERE userID=$1", userID).Scan(&sum, &held)
+			if err != nil {
+				logger.FromContext(ctx).Error("Failed to get balance", zap.String("error", err.Error()))
+				return err
+			}
+
+			expired, err = expireLots(ctx, tx, userID, sum-held)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, "UPDATE balance SET sum=sum-$1 WHERE userID=$2", expired, userID)
+			if err != nil {
+				logger.FromContext(ctx).Error("Failed to update balance", zap.String("error", err.Error()))
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		total += expired
+	}
+	return users, total, nil
+}
+
+// expireLots writes off up to limit points from the expired lots of the user, oldest first.
+func expireLots(ctx context.Context, tx *sql.Tx, userID string, limit float32) (float32, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, remaining FROM lots WHERE userID=$1 AND remaining > 0 AND expires <= current_timestamp ORDER BY expires, id FOR UPDATE", userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get expired lots", zap.String("error", err.Error()))
+		return 0, err
+	}
+	type lot struct {
+		id        int64
+		remaining float32
+	}
+	var lots []lot
+	for rows.Next() {
+		var item lot
+		if err := rows.Scan(&item.id, &item.remaining); err != nil {
+			rows.Close()
+			logger.FromContext(ctx).Error("Failed to scan lot", zap.String("error", err.Error()))
+			return 0, err
+		}
+		lots = append(lots, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return 0, err
+	}
+
+	var expired float32
+	for _, item := range lots {
+		if limit <= balanceTolerance {
+			break
+		}
+		amount := min(item.remaining, limit)
+		_, err := tx.ExecContext(ctx, "UPDATE lots SET expired=COALESCE(expired, 0)+$1, remaining=$2 WHERE id=$3", amount, item.remaining-amount, item.id)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to expire lot", zap.String("error", err.Error()))
+			return 0, err
+		}
+		limit -= amount
+		expired += amount
+	}
+	return expired, nil
+}
@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+// takeRateLimitQuery refills the bucket for the elapsed time and takes a token if one is available.
+const takeRateLimitQuery = `
+INSERT INTO rate_limits AS rl (key, tokens, allowed, updated) VALUES ($1, $3 - 1, true, clock_timestamp())
+ON CONFLICT (key) DO UPDATE SET
+	tokens = LEAST($3, rl.tokens + EXTRACT(EPOCH FROM clock_timestamp() - rl.updated) * $2)
+		- CASE WHEN LEAST($3, rl.tokens + EXTRACT(EPOCH FROM clock_timestamp() - rl.updated) * $2) >= 1 THEN 1 ELSE 0 END,
+	allowed = LEAST($3, rl.tokens + EXTRACT(EPOCH FROM clock_timestamp() - rl.updated) * $2) >= 1,
+	updated = clock_timestamp()
+RETURNING allowed, tokens`
+
+func (r *Database) TakeRateLimitToken(ctx context.Context, key string, rate float64, burst int) (bool, float64, error) {
+	ctx, span := startSpan(ctx, "TakeRateLimitToken")
+	defer span.End()
+
+	var allowed bool
+	var tokens float64
+	err := r.db.QueryRowContext(ctx, takeRateLimitQuery, key, rate, burst).Scan(&allowed, &tokens)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to take rate limit token", zap.String("error", err.Error()))
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+func (r *Database) DeleteStaleRateLimits(ctx context.Context, olderThan time.Duration) error {
+	ctx, span := startSpan(ctx, "DeleteStaleRateLimits")
+	defer span.End()
+
+	_, err := r.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE updated < clock_timestamp() - $1 * interval '1 second'", olderThan.Seconds())
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to delete stale rate limits", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
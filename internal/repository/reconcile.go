@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+const balanceTolerance = 0.01
+
+const reconcileQuery = `WITH accruals AS (
+		SELECT userID, SUM(accrual) AS total FROM orders WHERE status='PROCESSED' GROUP BY userID
+	), adjusted AS (
+		SELECT userID, SUM(amount) AS total FROM adjustments GROUP BY userID
+	), withdrawn AS (
+		SELECT userID, SUM(sum) AS total FROM withdrawals GROUP BY userID
+	), refunded AS (
+		SELECT userID, SUM(amount) AS total FROM refunds GROUP BY userID
+	), spent AS (
+		SELECT w.userID, w.total - COALESCE(rf.total, 0) AS total FROM withdrawn w LEFT JOIN refunded rf ON rf.userID = w.userID
+	), transferred AS (
+		SELECT userID, SUM(amount) AS total FROM (
+			SELECT toUserID AS userID, amount FROM transfers
+			UNION ALL
+			SELECT fromUserID, -amount FROM transfers
+		) t GROUP BY userID
+	), expired AS (
+		SELECT userID, SUM(expired) AS total FROM lots WHERE expired > 0 GROUP BY userID
+	), accounts AS (
+		SELECT userID FROM accruals UNION SELECT userID FROM adjusted UNION SELECT userID FROM spent
+		UNION SELECT userID FROM transferred UNION SELECT userID FROM balance
+	)
+	SELECT a.userID, COALESCE(b.sum, 0), COALESCE(b.withDrawn, 0),
+		COALESCE(acc.total, 0) + COALESCE(adj.total, 0) + COALESCE(t.total, 0) - COALESCE(s.total, 0) - COALESCE(e.total, 0),
+		COALESCE(s.total, 0)
+	FROM accounts a
+	LEFT JOIN balance b ON b.userID = a.userID
+	LEFT JOIN accruals acc ON acc.userID = a.userID
+	LEFT JOIN adjusted adj ON adj.userID = a.userID
+	LEFT JOIN spent s ON s.userID = a.userID
+	LEFT JOIN transferred t ON t.userID = a.userID
+	LEFT JOIN expired e ON e.userID = a.userID`
+
+func differs(a float32, b float32) bool {
+	return math.Abs(float64(a)-float64(b)) > balanceTolerance
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func insertAuditRecord(ctx context.Context, tx execer, actor string, action string, userID string, details any) error {
+	data, err := json.Marshal(details)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal audit details", zap.String("error", err.Error()))
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO audit_log (actor, action, userID, details, date) Values ($1, $2, $3, $4, current_timestamp)", actor, action, userID, string(data))
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert audit record", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (r *Database) Reconcile(ctx context.Context, fix bool) ([]models.BalanceDiscrepancy, error) {
+	ctx, span := startSpan(ctx, "Reconcile")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if fix {
+		_, err = tx.ExecContext(ctx, "LOCK TABLE balance IN SHARE ROW EXCLUSIVE MODE")
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to lock balance table", zap.String("error", err.Error()))
+			return nil, err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, reconcileQuery)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to reconcile balances", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	var result []models.BalanceDiscrepancy
+	for rows.Next() {
+		var item models.BalanceDiscrepancy
+		if err := rows.Scan(&item.UserID, &item.Current, &item.Withdrawn, &item.ExpectedCurrent, &item.ExpectedWithdrawn); err != nil {
+			rows.Close()
+			logger.FromContext(ctx).Error("Failed to scan reconcile result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		if differs(item.Current, item.ExpectedCurrent) || differs(item.Withdrawn, item.ExpectedWithdrawn) {
+			result = append(result, item)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	if !fix {
+		return result, nil
+	}
+	// the ledger may legitimately end in debt after clawbacks
+	if err := allowDebt(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	for i, item := range result {
+		query := `INSERT INTO balance (userID, sum, withDrawn) Values ($1, $2, $3) ON CONFLICT (userID) DO UPDATE SET sum=EXCLUDED.sum, withDrawn=EXCLUDED.withDrawn`
+		_, err = tx.ExecContext(ctx, query, item.UserID, item.ExpectedCurrent, item.ExpectedWithdrawn)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to fix balance", zap.String("error", err.Error()))
+			return nil, err
+		}
+		if _, err := r.syncLots(ctx, tx, item.UserID, nil); err != nil {
+			return nil, err
+		}
+
+		item.Fixed = true
+		if err := insertAuditRecord(ctx, tx, "reconcile", "balance.reconcile", item.UserID, item); err != nil {
+			return nil, err
+		}
+		result[i] = item
+	}
+
+	return result, tx.Commit()
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+func withdrawalStatus(sum float32, refunded float32) string {
+	switch {
+	case refunded <= 0:
+		return models.WithdrawalCompleted
+	case !differs(sum, refunded):
+		return models.WithdrawalRefunded
+	default:
+		return models.WithdrawalPartiallyRefunded
+	}
+}
+
+// RefundWithdrawal returns amount points of the withdrawal back to the balance, zero amount refunds the rest.
+func (r *Database) RefundWithdrawal(ctx context.Context, actor string, withdrawalID int64, req models.RefundRequest) (models.RefundRecord, error) {
+	ctx, span := startSpan(ctx, "RefundWithdrawal")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return models.RefundRecord{}, err
+	}
+	defer tx.Rollback()
+
+	rec := models.RefundRecord{WithdrawalID: withdrawalID, Reason: req.Reason, Actor: actor}
+	var sum, refunded float32
+	err = tx.QueryRowContext(ctx, "SELECT userID, number, sum, COALESCE(refunded, 0) FROM withdrawals WHERE id=$1 FOR UPDATE", withdrawalID).
+		Scan(&rec.UserID, &rec.Order, &sum, &refunded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.RefundRecord{}, myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get withdrawal", zap.String("error", err.Error()))
+		return models.RefundRecord{}, err
+	}
+
+	remaining := sum - refunded
+	rec.Amount = req.Amount
+	if rec.Amount == 0 {
+		rec.Amount = remaining
+	}
+	if remaining <= balanceTolerance || rec.Amount > remaining {
+		return models.RefundRecord{}, myerrors.ErrConflict
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE withdrawals SET refunded=COALESCE(refunded, 0)+$1 WHERE id=$2", rec.Amount, withdrawalID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to update withdrawal", zap.String("error", err.Error()))
+		return models.RefundRecord{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE balance SET sum=sum+$1, withDrawn=withDrawn-$1 WHERE userID=$2", rec.Amount, rec.UserID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to update balance", zap.String("error", err.Error()))
+		return models.RefundRecord{}, err
+	}
+	// refunded points return into lots with the expiries they were withdrawn from
+	parts, err := refundedLots(ctx, tx, withdrawalID, refunded, rec.Amount)
+	if err != nil {
+		return models.RefundRecord{}, err
+	}
+	if _, err := r.syncLots(ctx, tx, rec.UserID, parts); err != nil {
+		return models.RefundRecord{}, err
+	}
+
+	var created time.Time
+	err = tx.QueryRowContext(ctx, "INSERT INTO refunds (withdrawalID, userID, amount, reason, actor, date) Values ($1, $2, $3, $4, $5, current_timestamp) RETURNING id, date",
+		withdrawalID, rec.UserID, rec.Amount, rec.Reason, actor).Scan(&rec.ID, &created)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert refund", zap.String("error", err.Error()))
+		return models.RefundRecord{}, err
+	}
+	rec.CreatedAt = created.Format(time.RFC3339)
+
+	if err := insertAuditRecord(ctx, tx, actor, "withdrawal.refund", rec.UserID, rec); err != nil {
+		return models.RefundRecord{}, err
+	}
+	if err := insertWebhookEvent(ctx, tx, rec.UserID, models.WebhookWithdrawalRefunded, rec); err != nil {
+		return models.RefundRecord{}, err
+	}
+	return rec, tx.Commit()
+}
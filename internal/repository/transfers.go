@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+const maxTransferAttempts = 3
+
+// TransferLimits caps the amount and the number of transfers a user sends per day, zero disables a cap.
+type TransferLimits struct {
+	Amount float32
+	Count  int
+}
+
+// retryableTransferError reports errors after which the serializable transfer may succeed on retry.
+// Unique violation means a concurrent request with the same key won, the retry replays it.
+func retryableTransferError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == pgerrcode.SerializationFailure || pgErr.Code == pgerrcode.DeadlockDetected ||
+		pgErr.Code == pgerrcode.UniqueViolation
+}
+
+// Transfer moves req.Sum from the user to the user with req.Login once per idempotency key.
+// It reports whether an earlier transfer with the same key was returned instead.
+func (r *Database) Transfer(ctx context.Context, userID string, key string, req models.TransferRequest, limits TransferLimits) (models.TransferRecord, bool, error) {
+	ctx, span := startSpan(ctx, "Transfer")
+	defer span.End()
+
+	for attempt := 1; ; attempt++ {
+		rec, replayed, err := r.transfer(ctx, userID, key, req, limits)
+		if err != nil && attempt < maxTransferAttempts && retryableTransferError(err) {
+			logger.FromContext(ctx).Info("retrying transfer", zap.Int("attempt", attempt), zap.String("error", err.Error()))
+			continue
+		}
+		return rec, replayed, err
+	}
+}
+
+func (r *Database) transfer(ctx context.Context, userID string, key string, req models.TransferRequest, limits TransferLimits) (models.TransferRecord, bool, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	defer tx.Rollback()
+
+	rec := models.TransferRecord{Login: req.Login, Sum: req.Sum}
+	var created time.Time
+	err = tx.QueryRowContext(ctx, `SELECT t.id, t.toUserID, u.userName, t.amount, t.date FROM transfers t
+		JOIN users u ON u.userID = t.toUserID WHERE t.fromUserID=$1 AND t.idempotencyKey=$2`, userID, key).
+		Scan(&rec.ID, &rec.ToUserID, &rec.Login, &rec.Sum, &created)
+	if err == nil {
+		if rec.Login != req.Login || differs(rec.Sum, req.Sum) {
+			return models.TransferRecord{}, false, myerrors.ErrConflict
+		}
+		rec.CreatedAt = created.Format(time.RFC3339)
+		return rec, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		logger.FromContext(ctx).Error("Failed to get transfer", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT userID FROM users WHERE userName=$1", req.Login).Scan(&rec.ToUserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.TransferRecord{}, false, myerrors.ErrNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get recipient", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	if rec.ToUserID == userID {
+		return models.TransferRecord{}, false, myerrors.ErrInvalid
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO balance (userID, sum, withDrawn) Values ($1, 0.0, 0.0) ON CONFLICT (userID) DO NOTHING", rec.ToUserID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create recipient balance", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+
+	// both rows are locked in userID order, so opposite transfers can not deadlock
+	rows, err := tx.QueryContext(ctx, "SELECT userID, sum, "+heldQuery+" FROM balance WHERE userID IN ($1, $2) ORDER BY userID FOR UPDATE", userID, rec.ToUserID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to lock balances", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	var found bool
+	var current, held float32
+	for rows.Next() {
+		var id string
+		var sum, h float32
+		if err := rows.Scan(&id, &sum, &h); err != nil {
+			rows.Close()
+			logger.FromContext(ctx).Error("Failed to scan balance", zap.String("error", err.Error()))
+			return models.TransferRecord{}, false, err
+		}
+		if id == userID {
+			found, current, held = true, sum, h
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	if !found {
+		return models.TransferRecord{}, false, myerrors.ErrNotEnoughtMoney
+	}
+	pending, err := r.pendingPoints(ctx, tx, userID)
+	if err != nil {
+		return models.TransferRecord{}, false, err
+	}
+	if current < 0 {
+		return models.TransferRecord{}, false, myerrors.ErrDebt
+	}
+	if current-held-pending < req.Sum {
+		return models.TransferRecord{}, false, myerrors.ErrNotEnoughtMoney
+	}
+
+	var sent float32
+	var count int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM transfers WHERE fromUserID=$1 AND date >= date_trunc('day', current_timestamp)", userID).
+		Scan(&sent, &count)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get daily transfers", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	if (limits.Count > 0 && count >= limits.Count) || (limits.Amount > 0 && sent+req.Sum > limits.Amount+balanceTolerance) {
+		return models.TransferRecord{}, false, myerrors.ErrLimitExceeded
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE balance SET sum=sum-$1 WHERE userID=$2", req.Sum, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to debit balance", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE balance SET sum=sum+$1 WHERE userID=$2", req.Sum, rec.ToUserID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to credit balance", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	// the recipient gets the sender lots expiries, so passing points around does not renew them
+	moved, err := r.syncLots(ctx, tx, userID, nil)
+	if err != nil {
+		return models.TransferRecord{}, false, err
+	}
+	if _, err := r.syncLots(ctx, tx, rec.ToUserID, moved); err != nil {
+		return models.TransferRecord{}, false, err
+	}
+
+	err = tx.QueryRowContext(ctx, "INSERT INTO transfers (fromUserID, toUserID, amount, idempotencyKey, date) Values ($1, $2, $3, $4, current_timestamp) RETURNING id, date",
+		userID, rec.ToUserID, req.Sum, key).Scan(&rec.ID, &created)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert transfer", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	rec.CreatedAt = created.Format(time.RFC3339)
+
+	if err := tx.Commit(); err != nil {
+		logger.FromContext(ctx).Error("Failed to commit transfer", zap.String("error", err.Error()))
+		return models.TransferRecord{}, false, err
+	}
+	return rec, false, nil
+}
@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"go.uber.org/zap"
+)
+
+func insertWebhookEvent(ctx context.Context, tx *sql.Tx, userID string, event string, data any) error {
+	payload, err := json.Marshal(models.WebhookPayload{
+		Event:     event,
+		UserID:    userID,
+		Data:      data,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal webhook payload", zap.String("error", err.Error()))
+		return err
+	}
+
+	query := `INSERT INTO webhook_deliveries (webhookID, userID, event, payload, status, attempts, nextAttempt, lastError, date)
+		SELECT id, userID, $2, $3, 'PENDING', 0, current_timestamp, '', current_timestamp FROM webhooks
+		WHERE userID=$1 AND (events='' OR $2 = ANY(string_to_array(events, ',')))`
+	_, err = tx.ExecContext(ctx, query, userID, event, string(payload))
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert webhook delivery", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func insertWebhook(ctx context.Context, q execer, userID string, rec models.WebhookRecord) error {
+	_, err := q.ExecContext(ctx, "INSERT INTO webhooks (id, userID, url, secret, events, date) Values ($1, $2, $3, $4, $5, current_timestamp)",
+		rec.ID, userID, rec.URL, rec.Secret, strings.Join(rec.Events, ","))
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to insert webhook", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (r *Database) CreateWebhook(ctx context.Context, userID string, rec models.WebhookRecord) error {
+	ctx, span := startSpan(ctx, "CreateWebhook")
+	defer span.End()
+
+	return insertWebhook(ctx, r.db, userID, rec)
+}
+
+// AdminCreateWebhook registers a webhook on behalf of the user and records it in the audit log.
+func (r *Database) AdminCreateWebhook(ctx context.Context, actor string, userID string, rec models.WebhookRecord) error {
+	ctx, span := startSpan(ctx, "AdminCreateWebhook")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkUserExists(ctx, tx, userID); err != nil {
+		return err
+	}
+	if err := insertWebhook(ctx, tx, userID, rec); err != nil {
+		return err
+	}
+
+	details := map[string]any{"id": rec.ID, "url": rec.URL, "events": rec.Events}
+	if err := insertAuditRecord(ctx, tx, actor, "admin.webhook.create", userID, details); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Database) GetWebhooks(ctx context.Context, userID string) ([]models.WebhookRecord, error) {
+	ctx, span := startSpan(ctx, "GetWebhooks")
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT id, url, events, date FROM webhooks WHERE userID=$1 ORDER BY date", userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get webhooks", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.WebhookRecord
+	for rows.Next() {
+		var item models.WebhookRecord
+		var events string
+		if err := rows.Scan(&item.ID, &item.URL, &events, &item.CreatedAt); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan get webhooks result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		item.Events = []string{}
+		if events != "" {
+			item.Events = strings.Split(events, ",")
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) DeleteWebhook(ctx context.Context, userID string, id string) error {
+	ctx, span := startSpan(ctx, "DeleteWebhook")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id=$1 AND userID=$2", id, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to delete webhook", zap.String("error", err.Error()))
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return myerrors.ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE webhookID=$1", id)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to delete webhook deliveries", zap.String("error", err.Error()))
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Database) GetWebhookDeliveries(ctx context.Context, userID string, webhookID string) ([]models.WebhookDeliveryRecord, error) {
+	ctx, span := startSpan(ctx, "GetWebhookDeliveries")
+	defer span.End()
+
+	query := `SELECT id, webhookID, event, status, attempts, lastError, nextAttempt, date FROM webhook_deliveries
+		WHERE userID=$1 AND webhookID=$2 ORDER BY id DESC`
+	rows, err := r.db.QueryContext(ctx, query, userID, webhookID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get webhook deliveries", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.WebhookDeliveryRecord
+	for rows.Next() {
+		var item models.WebhookDeliveryRecord
+		if err := rows.Scan(&item.ID, &item.WebhookID, &item.Event, &item.Status, &item.Attempts, &item.LastError, &item.NextAttempt, &item.CreatedAt); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan get webhook deliveries result", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func redeliverWebhook(ctx context.Context, q execer, userID string, deliveryID int64) error {
+	query := `UPDATE webhook_deliveries SET status='PENDING', attempts=0, nextAttempt=current_timestamp, lastError=''
+		WHERE id=$1 AND userID=$2`
+	res, err := q.ExecContext(ctx, query, deliveryID, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to redeliver webhook", zap.String("error", err.Error()))
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return myerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (r *Database) RedeliverWebhook(ctx context.Context, userID string, deliveryID int64) error {
+	ctx, span := startSpan(ctx, "RedeliverWebhook")
+	defer span.End()
+
+	return redeliverWebhook(ctx, r.db, userID, deliveryID)
+}
+
+// AdminRedeliverWebhook schedules a delivery of the user again and records it in the audit log.
+func (r *Database) AdminRedeliverWebhook(ctx context.Context, actor string, userID string, deliveryID int64) error {
+	ctx, span := startSpan(ctx, "AdminRedeliverWebhook")
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create transaction", zap.String("error", err.Error()))
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeliverWebhook(ctx, tx, userID, deliveryID); err != nil {
+		return err
+	}
+	if err := insertAuditRecord(ctx, tx, actor, "admin.webhook.redeliver", userID, map[string]int64{"delivery": deliveryID}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Database) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctx, span := startSpan(ctx, "ClaimWebhookDeliveries")
+	defer span.End()
+
+	query := `UPDATE webhook_deliveries d SET nextAttempt = current_timestamp + make_interval(secs => $2)
+		FROM webhooks w
+		WHERE w.id = d.webhookID AND d.id IN (
+			SELECT id FROM webhook_deliveries WHERE status='PENDING' AND nextAttempt <= current_timestamp
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret`
+	rows, err := r.db.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to claim webhook deliveries", zap.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.WebhookDelivery
+	for rows.Next() {
+		var item models.WebhookDelivery
+		if err := rows.Scan(&item.ID, &item.Event, &item.Payload, &item.Attempts, &item.URL, &item.Secret); err != nil {
+			logger.FromContext(ctx).Error("Failed to scan claimed webhook deliveries", zap.String("error", err.Error()))
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		logger.FromContext(ctx).Error("Failed to iterate db", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Database) CompleteWebhookDelivery(ctx context.Context, id int64) error {
+	ctx, span := startSpan(ctx, "CompleteWebhookDelivery")
+	defer span.End()
+
+	_, err := r.db.ExecContext(ctx, "UPDATE webhook_deliveries SET status='DELIVERED', attempts=attempts+1, lastError='' WHERE id=$1", id)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to complete webhook delivery", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (r *Database) FailWebhookDelivery(ctx context.Context, id int64, deliveryErr string, retryAfter time.Duration, dead bool) error {
+	ctx, span := startSpan(ctx, "FailWebhookDelivery")
+	defer span.End()
+
+	status := models.WebhookDeliveryPending
+	if dead {
+		status = models.WebhookDeliveryDead
+	}
+	query := `UPDATE webhook_deliveries SET status=$2, attempts=attempts+1, lastError=$3,
+		nextAttempt=current_timestamp + make_interval(secs => $4) WHERE id=$1`
+	_, err := r.db.ExecContext(ctx, query, id, status, deliveryErr, retryAfter.Seconds())
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to fail webhook delivery", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
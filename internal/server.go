@@ -1,13 +1,23 @@
 package app
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rutkin/gofermart/internal/config"
 	"github.com/rutkin/gofermart/internal/handlers"
 	"github.com/rutkin/gofermart/internal/logger"
 	"github.com/rutkin/gofermart/internal/middleware"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/ratelimit"
 	"go.uber.org/zap"
 )
 
@@ -16,32 +26,235 @@ func MakeServer(config *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Server{config, handler}, nil
+	server := &Server{config: config, handler: handler}
+	server.clientIP, err = ratelimit.NewClientIP(config.TrustedProxies)
+	if err != nil {
+		handler.Close()
+		return nil, err
+	}
+	store := handler.NewRateLimitStore(config.RateLimitStore)
+	server.authLimiter = ratelimit.NewLimiter("auth", store, ratelimit.Limit{})
+	server.ordersLimiter = ratelimit.NewLimiter("orders", store, ratelimit.Limit{})
+	server.apiLimiter = ratelimit.NewLimiter("api", store, ratelimit.Limit{})
+	if err := server.applyRateLimits(config); err != nil {
+		handler.Close()
+		return nil, err
+	}
+	if config.TLSCertFile != "" {
+		server.certs, err = newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			handler.Close()
+			return nil, err
+		}
+	}
+	return server, nil
 }
 
 type Server struct {
 	config  *config.Config
 	handler *handlers.Handler
+	certs   *certReloader
+
+	clientIP      *ratelimit.ClientIP
+	authLimiter   *ratelimit.Limiter
+	ordersLimiter *ratelimit.Limiter
+	apiLimiter    *ratelimit.Limiter
+}
+
+func (s *Server) applyRateLimits(config *config.Config) error {
+	for _, group := range []struct {
+		limiter *ratelimit.Limiter
+		value   string
+	}{
+		{s.authLimiter, config.RateLimitAuth},
+		{s.ordersLimiter, config.RateLimitOrders},
+		{s.apiLimiter, config.RateLimitAPI},
+	} {
+		limit, err := ratelimit.ParseLimit(group.value)
+		if err != nil {
+			return err
+		}
+		group.limiter.SetLimit(limit)
+	}
+	return nil
 }
 
 func (s *Server) Start() {
-	logger.Log.Info("running server", zap.String("address", s.config.RunAddress))
-	err := http.ListenAndServe(s.config.RunAddress, s.newRouter())
-	if err != nil {
-		panic(err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go s.watchReload(ctx)
+
+	var adminServer *http.Server
+	if s.config.AdminAddress != "" {
+		adminServer = &http.Server{Addr: s.config.AdminAddress, Handler: s.newAdminRouter()}
+		go s.serve(adminServer, "admin")
+	}
+
+	server := &http.Server{
+		Addr:              s.config.RunAddress,
+		Handler:           s.newRouter(),
+		ReadTimeout:       s.config.ReadTimeout,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+	}
+	if s.certs != nil {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: s.certs.GetCertificate}
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serve(server, "api")
+	}()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			panic(err)
+		}
+	case <-ctx.Done():
+	}
+
+	logger.Log.Info("shutting down server")
+	s.handler.StartShutdown()
+	time.Sleep(s.config.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Log.Error("failed to shutdown server", zap.String("error", err.Error()))
 	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			logger.Log.Error("failed to shutdown admin server", zap.String("error", err.Error()))
+		}
+	}
+	s.handler.Close()
 	logger.Log.Info("Server stopped")
 }
 
+func (s *Server) watchReload(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.reload()
+		}
+	}
+}
+
+func (s *Server) reload() {
+	config, err := s.config.Reload()
+	if err != nil {
+		logger.Log.Error("failed to reload config", zap.String("error", err.Error()))
+		return
+	}
+	if err := logger.SetLevel(config.LogLevel); err != nil {
+		logger.Log.Error("failed to set log level", zap.String("error", err.Error()))
+		return
+	}
+	s.handler.ApplyConfig(config)
+	if err := s.applyRateLimits(config); err != nil {
+		logger.Log.Error("failed to apply rate limits", zap.String("error", err.Error()))
+	}
+	if s.certs != nil {
+		if err := s.certs.Load(); err != nil {
+			logger.Log.Error("failed to reload tls certificate", zap.String("error", err.Error()))
+		}
+	}
+	logger.Log.Info("config reloaded", zap.String("log_level", config.LogLevel), zap.Int("orders_workers", config.OrdersWorkers))
+}
+
+func (s *Server) serve(server *http.Server, name string) error {
+	logger.Log.Info("running server", zap.String("name", name), zap.String("address", server.Addr))
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Log.Error("server stopped", zap.String("name", name), zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (s *Server) newAdminRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/healthz", s.handler.Healthz)
+	r.Get("/readyz", s.handler.Readyz)
+	if s.config.AdminToken != "" {
+		r.With(middleware.WithAdminToken(s.config.AdminToken)).Handle("/loglevel", logger.Level)
+	}
+	return r
+}
+
 func (s *Server) newRouter() http.Handler {
 	r := chi.NewRouter()
-	r.Post("/api/user/register", s.handler.Register)
-	r.Post("/api/user/login", s.handler.Login)
-	userIDRouter := r.With(middleware.WithAuth)
-	userIDRouter.Post("/api/user/orders", s.handler.CreateOrder)
-	userIDRouter.Get("/api/user/orders", s.handler.GetOrders)
-	userIDRouter.Get("/api/user/balance", s.handler.GetBalance)
-	userIDRouter.Post("/api/user/balance/withdraw", s.handler.Withdraw)
-	userIDRouter.Get("/api/user/withdrawals", s.handler.GetWithdrawals)
+	r.Use(middleware.WithTracing)
+	r.Use(middleware.WithMetrics)
+	r.Use(middleware.WithLogging)
+	r.Use(middleware.WithSecurityHeaders)
+	r.Use(middleware.WithCompression(s.config.CompressionMinSize))
+	r.Use(middleware.WithCSRF(s.config.CSRFTrustedOrigins))
+	r.Get("/healthz", s.handler.Healthz)
+	r.Get("/readyz", s.handler.PublicReadyz)
+	userKey := middleware.UserRateLimitKey
+	decompress := middleware.WithDecompression(s.config.MaxDecompressedBodySize)
+	limited := r.With(middleware.WithMaxBytes(s.config.MaxBodySize), decompress)
+	limited.Post("/api/internal/accrual/callback", s.handler.AccrualCallback)
+	authRouter := limited.With(middleware.WithRateLimit(s.authLimiter, middleware.IPRateLimitKey(s.clientIP)))
+	authRouter.Post("/api/user/register", s.handler.Register)
+	authRouter.Post("/api/user/login", s.handler.Login)
+	auth := middleware.WithAuth(s.handler.APIKeys())
+	scope := middleware.RequireScope
+	ordersLimit := middleware.WithRateLimit(s.ordersLimiter, userKey)
+	r.With(middleware.WithMaxBytes(s.config.MaxBatchBodySize), decompress, auth, ordersLimit, scope(models.ScopeOrdersWrite)).
+		Post("/api/user/orders/batch", s.handler.CreateOrders)
+	limited.With(auth, ordersLimit, scope(models.ScopeOrdersWrite)).Post("/api/user/orders", s.handler.CreateOrder)
+	userIDRouter := limited.With(auth, middleware.WithRateLimit(s.apiLimiter, userKey))
+	userIDRouter.With(scope(models.ScopeOrdersRead)).Get("/api/user/orders", s.handler.GetOrders)
+	userIDRouter.With(scope(models.ScopeOrdersRead)).Get("/api/user/orders/{number}", s.handler.GetOrder)
+	userIDRouter.With(scope(models.ScopeOrdersRead)).Post("/api/user/orders/status", s.handler.GetOrdersStatus)
+	userIDRouter.With(scope(models.ScopeOrdersRead)).Get("/api/user/orders/events", s.handler.OrderEvents)
+	userIDRouter.With(scope(models.ScopeBalanceRead)).Get("/api/user/balance", s.handler.GetBalance)
+	userIDRouter.With(scope(models.ScopeBalanceWrite)).Post("/api/user/balance/withdraw", s.handler.Withdraw)
+	userIDRouter.With(scope(models.ScopeBalanceWrite)).Post("/api/user/balance/transfer", s.handler.Transfer)
+	userIDRouter.With(scope(models.ScopeBalanceRead)).Get("/api/user/balance/history", s.handler.GetBalanceHistory)
+	userIDRouter.With(scope(models.ScopeBalanceWrite)).Post("/api/user/balance/holds", s.handler.CreateHold)
+	userIDRouter.With(scope(models.ScopeBalanceRead)).Get("/api/user/balance/holds", s.handler.GetHolds)
+	userIDRouter.With(scope(models.ScopeBalanceWrite)).Post("/api/user/balance/holds/{id}/capture", s.handler.CaptureHold)
+	userIDRouter.With(scope(models.ScopeBalanceWrite)).Post("/api/user/balance/holds/{id}/release", s.handler.ReleaseHold)
+	userIDRouter.With(scope(models.ScopeBalanceRead)).Get("/api/user/withdrawals", s.handler.GetWithdrawals)
+	userIDRouter.With(scope(models.ScopeWebhooksWrite)).Post("/api/user/webhooks", s.handler.CreateWebhook)
+	userIDRouter.With(scope(models.ScopeWebhooksRead)).Get("/api/user/webhooks", s.handler.GetWebhooks)
+	userIDRouter.With(scope(models.ScopeWebhooksWrite)).Delete("/api/user/webhooks/{id}", s.handler.DeleteWebhook)
+	userIDRouter.With(scope(models.ScopeWebhooksRead)).Get("/api/user/webhooks/{id}/deliveries", s.handler.GetWebhookDeliveries)
+	userIDRouter.With(scope(models.ScopeWebhooksWrite)).Post("/api/user/webhooks/deliveries/{id}/redeliver", s.handler.RedeliverWebhook)
+	sessionRouter := userIDRouter.With(middleware.RequireSession)
+	sessionRouter.Post("/api/user/keys", s.handler.CreateAPIKey)
+	sessionRouter.Get("/api/user/keys", s.handler.GetAPIKeys)
+	sessionRouter.Delete("/api/user/keys/{id}", s.handler.DeleteAPIKey)
+
+	adminRouter := limited.With(auth, middleware.WithRateLimit(s.apiLimiter, userKey), middleware.RequireSession,
+		middleware.RequireRole(s.handler.Roles(), models.RoleAdmin))
+	adminRouter.Get("/api/admin/users", s.handler.AdminSearchUsers)
+	adminRouter.Get("/api/admin/users/{userID}/orders", s.handler.AdminGetUserOrders)
+	adminRouter.Get("/api/admin/users/{userID}/withdrawals", s.handler.AdminGetUserWithdrawals)
+	adminRouter.Get("/api/admin/users/{userID}/balance", s.handler.AdminGetUserBalance)
+	adminRouter.Post("/api/admin/users/{userID}/adjustments", s.handler.AdminAdjustBalance)
+	adminRouter.Post("/api/admin/users/{userID}/webhooks", s.handler.AdminCreateWebhook)
+	adminRouter.Get("/api/admin/users/{userID}/webhooks", s.handler.AdminGetUserWebhooks)
+	adminRouter.Post("/api/admin/users/{userID}/webhooks/deliveries/{id}/redeliver", s.handler.AdminRedeliverWebhook)
+	adminRouter.Post("/api/admin/orders/{number}/requeue", s.handler.AdminRequeueOrder)
+	adminRouter.Post("/api/admin/orders/{number}/reverse", s.handler.AdminReverseOrder)
+	adminRouter.Post("/api/admin/withdrawals/{id}/refund", s.handler.AdminRefundWithdrawal)
+	adminRouter.Get("/api/admin/audit", s.handler.AdminGetAuditLog)
 	return r
 }
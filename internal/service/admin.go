@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxAdjustmentReasonLen = 500
+
+// adjustmentSigns tells which direction each reason code may move the balance, 0 allows both.
+var adjustmentSigns = map[string]int{
+	models.AdjustmentGoodwill:   1,
+	models.AdjustmentCorrection: 0,
+	models.AdjustmentFraud:      -1,
+	models.AdjustmentChargeback: -1,
+}
+
+func validReason(reason string) bool {
+	return reason != "" && len(reason) <= maxAdjustmentReasonLen
+}
+
+func (s *Service) GetUserRole(ctx context.Context, userID string) (string, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetUserRole")
+	defer span.End()
+
+	return s.db.GetUserRole(ctx, userID)
+}
+
+func (s *Service) SetUserRole(ctx context.Context, actor string, login string, role string) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.SetUserRole")
+	defer span.End()
+
+	if role != models.RoleUser && role != models.RoleAdmin {
+		return myerrors.ErrInvalid
+	}
+	return s.db.SetUserRole(ctx, actor, login, role)
+}
+
+func (s *Service) SearchUsers(ctx context.Context, actor string, query string, limit int, offset int) ([]models.AdminUserRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.SearchUsers")
+	defer span.End()
+
+	users, err := s.db.SearchUsers(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]any{"query": query, "limit": limit, "offset": offset}
+	if err := s.db.InsertAuditRecord(ctx, actor, "admin.users.search", "", details); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *Service) GetUserOrders(ctx context.Context, actor string, userID string) (models.OrdersResponse, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetUserOrders")
+	defer span.End()
+
+	orders, err := s.GetOrders(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.InsertAuditRecord(ctx, actor, "admin.user.orders", userID, nil); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (s *Service) GetUserWithdrawals(ctx context.Context, actor string, userID string) ([]models.WithdrawalResponse, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetUserWithdrawals")
+	defer span.End()
+
+	withdrawals, err := s.GetWithdrawals(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.InsertAuditRecord(ctx, actor, "admin.user.withdrawals", userID, nil); err != nil {
+		return nil, err
+	}
+	return withdrawals, nil
+}
+
+func (s *Service) GetUserBalance(ctx context.Context, actor string, userID string) (models.BalanceRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetUserBalance")
+	defer span.End()
+
+	balance, err := s.GetBalance(ctx, userID)
+	if err != nil {
+		return models.BalanceRecord{}, err
+	}
+	if err := s.db.InsertAuditRecord(ctx, actor, "admin.user.balance", userID, nil); err != nil {
+		return models.BalanceRecord{}, err
+	}
+	return balance, nil
+}
+
+func (s *Service) AdminCreateWebhook(ctx context.Context, actor string, userID string, req models.WebhookRequest) (models.WebhookRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.AdminCreateWebhook")
+	defer span.End()
+
+	rec, err := newWebhook(ctx, req)
+	if err != nil {
+		return models.WebhookRecord{}, err
+	}
+	return rec, s.db.AdminCreateWebhook(ctx, actor, userID, rec)
+}
+
+func (s *Service) GetUserWebhooks(ctx context.Context, actor string, userID string) ([]models.WebhookRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetUserWebhooks")
+	defer span.End()
+
+	webhooks, err := s.db.GetWebhooks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.InsertAuditRecord(ctx, actor, "admin.user.webhooks", userID, nil); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (s *Service) AdminRedeliverWebhook(ctx context.Context, actor string, userID string, deliveryID int64) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.AdminRedeliverWebhook")
+	defer span.End()
+
+	return s.db.AdminRedeliverWebhook(ctx, actor, userID, deliveryID)
+}
+
+func (s *Service) RequeueOrder(ctx context.Context, actor string, number string) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.RequeueOrder")
+	defer span.End()
+
+	userID, err := s.db.RequeueOrder(ctx, actor, number)
+	if err != nil {
+		return err
+	}
+	// the operator asked for a poll, so it is queued even when the accrual system pushes results
+	if !s.enqueueOrder(orderTask{userID: userID, number: number, link: trace.SpanContextFromContext(ctx), log: logger.FromContext(ctx)}) && !s.orderInFlight(number) {
+		return myerrors.ErrUnavailable
+	}
+	return nil
+}
+
+func (s *Service) AdjustBalance(ctx context.Context, actor string, userID string, req models.AdjustmentRequest) (models.AdjustmentRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.AdjustBalance")
+	defer span.End()
+
+	amount := float64(req.Amount)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if amount == 0 || math.IsNaN(amount) || math.IsInf(amount, 0) || !validReason(req.Reason) {
+		return models.AdjustmentRecord{}, myerrors.ErrInvalid
+	}
+	sign, ok := adjustmentSigns[req.Code]
+	if !ok || (sign > 0 && amount < 0) || (sign < 0 && amount > 0) {
+		return models.AdjustmentRecord{}, myerrors.ErrInvalid
+	}
+
+	rec, err := s.db.AdjustBalance(ctx, actor, userID, req)
+	if err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+	s.publishBalance(ctx, userID)
+	return rec, nil
+}
+
+func (s *Service) ReverseOrderAccrual(ctx context.Context, actor string, number string, req models.ReversalRequest) (models.AdjustmentRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.ReverseOrderAccrual")
+	defer span.End()
+
+	reason := strings.TrimSpace(req.Reason)
+	if !validReason(reason) {
+		return models.AdjustmentRecord{}, myerrors.ErrInvalid
+	}
+
+	rec, err := s.db.ReverseOrderAccrual(ctx, actor, number, reason)
+	if err != nil {
+		return models.AdjustmentRecord{}, err
+	}
+	s.publishBalance(ctx, rec.UserID)
+	return rec, nil
+}
+
+func (s *Service) GetAuditLog(ctx context.Context, actor string, userID string, limit int) ([]models.AuditRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetAuditLog")
+	defer span.End()
+
+	records, err := s.db.GetAuditLog(ctx, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.InsertAuditRecord(ctx, actor, "admin.audit.view", userID, nil); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// RefundWithdrawal returns points of a withdrawal back to the user, fully when amount is omitted.
+func (s *Service) RefundWithdrawal(ctx context.Context, actor string, withdrawalID int64, req models.RefundRequest) (models.RefundRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.RefundWithdrawal")
+	defer span.End()
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if !validReason(req.Reason) || req.Amount < 0 {
+		return models.RefundRecord{}, myerrors.ErrInvalid
+	}
+
+	rec, err := s.db.RefundWithdrawal(ctx, actor, withdrawalID, req)
+	if err != nil {
+		return models.RefundRecord{}, err
+	}
+	s.publishBalance(ctx, rec.UserID)
+	return rec, nil
+}
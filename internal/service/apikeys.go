@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	apiKeyPrefix       = "gm_"
+	apiKeyPrefixLength = 10
+	maxAPIKeyNameLen   = 100
+)
+
+func generateAPIKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func validateAPIKeyRequest(req models.APIKeyRequest) error {
+	if strings.TrimSpace(req.Name) == "" || len(req.Name) > maxAPIKeyNameLen || len(req.Scopes) == 0 {
+		return myerrors.ErrInvalid
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.APIKeyScopes, scope) {
+			return myerrors.ErrInvalid
+		}
+	}
+	return nil
+}
+
+// CreateAPIKey returns the key itself only once, the database keeps its hash.
+func (s *Service) CreateAPIKey(ctx context.Context, userID string, req models.APIKeyRequest) (models.APIKeyRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.CreateAPIKey")
+	defer span.End()
+
+	if err := validateAPIKeyRequest(req); err != nil {
+		return models.APIKeyRecord{}, err
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to generate api key", zap.String("error", err.Error()))
+		return models.APIKeyRecord{}, err
+	}
+
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	rec := models.APIKeyRecord{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		Prefix:    key[:apiKeyPrefixLength],
+		Scopes:    slices.Compact(scopes),
+		Key:       key,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	return rec, s.db.CreateAPIKey(ctx, userID, rec, calculateHash(key))
+}
+
+func (s *Service) GetAPIKeys(ctx context.Context, userID string) ([]models.APIKeyRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetAPIKeys")
+	defer span.End()
+
+	return s.db.GetAPIKeys(ctx, userID)
+}
+
+func (s *Service) DeleteAPIKey(ctx context.Context, userID string, id string) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.DeleteAPIKey")
+	defer span.End()
+
+	return s.db.DeleteAPIKey(ctx, userID, id)
+}
+
+func (s *Service) AuthenticateAPIKey(ctx context.Context, key string) (string, []string, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.AuthenticateAPIKey")
+	defer span.End()
+
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", nil, myerrors.ErrNotFound
+	}
+	return s.db.UseAPIKey(ctx, calculateHash(key))
+}
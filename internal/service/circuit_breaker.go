@@ -0,0 +1,77 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+	probing   bool
+}
+
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = BreakerHalfOpen
+		cb.probing = true
+		return true
+	case BreakerHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (cb *circuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+	cb.probing = false
+	cb.state = BreakerClosed
+}
+
+func (cb *circuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	cb.probing = false
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+func (cb *circuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		return BreakerHalfOpen
+	}
+	return cb.state
+}
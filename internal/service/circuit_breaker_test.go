@@ -0,0 +1,80 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	cb := newCircuitBreaker(3, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		cb.Failure()
+		if got := cb.State(); got != BreakerClosed {
+			t.Fatalf("state after %d failures = %s, want %s", i+1, got, BreakerClosed)
+		}
+		if !cb.Allow() {
+			t.Fatalf("closed breaker refused a request after %d failures", i+1)
+		}
+	}
+
+	cb.Failure()
+	if got := cb.State(); got != BreakerOpen {
+		t.Fatalf("state = %s, want %s", got, BreakerOpen)
+	}
+	if cb.Allow() {
+		t.Fatal("open breaker allowed a request during cooldown")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	cb := newCircuitBreaker(2, time.Hour)
+
+	cb.Failure()
+	cb.Success()
+	cb.Failure()
+	if got := cb.State(); got != BreakerClosed {
+		t.Fatalf("state = %s, want %s since success reset the count", got, BreakerClosed)
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		succeeded bool
+		want      string
+	}{
+		{"probe succeeds", true, BreakerClosed},
+		{"probe fails", false, BreakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newCircuitBreaker(1, time.Hour)
+			cb.Failure()
+			// pretend the cooldown has passed
+			cb.openedAt = time.Now().Add(-2 * time.Hour)
+
+			if got := cb.State(); got != BreakerHalfOpen {
+				t.Fatalf("state after cooldown = %s, want %s", got, BreakerHalfOpen)
+			}
+			if !cb.Allow() {
+				t.Fatal("half open breaker refused the probe")
+			}
+			if cb.Allow() {
+				t.Fatal("half open breaker allowed a second request while probing")
+			}
+
+			if tt.succeeded {
+				cb.Success()
+			} else {
+				cb.Failure()
+			}
+			if got := cb.State(); got != tt.want {
+				t.Fatalf("state after probe = %s, want %s", got, tt.want)
+			}
+			if allowed := cb.Allow(); allowed != tt.succeeded {
+				t.Fatalf("Allow() after probe = %v, want %v", allowed, tt.succeeded)
+			}
+		})
+	}
+}
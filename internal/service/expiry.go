@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/metrics"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const expireUsersBatch = 100
+
+func (s *Service) pointsExpirer(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.expirePoints(context.Background())
+		}
+	}
+}
+
+func (s *Service) expirePoints(ctx context.Context) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.expirePoints")
+	defer span.End()
+
+	synced, err := s.db.SyncLegacyLots(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to sync legacy lots", zap.String("error", err.Error()))
+		return
+	}
+
+	users, total, err := s.db.ExpirePoints(ctx, expireUsersBatch)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to expire points", zap.String("error", err.Error()))
+		return
+	}
+	metrics.ExpiredPoints.Add(float64(total))
+	for _, userID := range users {
+		s.publishBalance(ctx, userID)
+	}
+	logger.FromContext(ctx).Info("expire points", zap.Int("legacy", synced), zap.Int("users", len(users)), zap.Float32("points", total))
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/repository"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+func (s *Service) Readiness(ctx context.Context) (models.HealthResponse, bool) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.Readiness")
+	defer span.End()
+
+	checks := make(map[string]models.HealthCheck)
+	ready := true
+	check := func(name string, ok bool, details string) {
+		status := HealthOK
+		if !ok {
+			status = HealthFail
+			ready = false
+		}
+		checks[name] = models.HealthCheck{Status: status, Details: details}
+	}
+
+	if err := s.db.Ping(ctx); err != nil {
+		logger.FromContext(ctx).Error("readiness: failed to ping database", zap.String("error", err.Error()))
+		check("database", false, err.Error())
+	} else {
+		check("database", true, "")
+	}
+
+	version, err := s.db.GetSchemaVersion(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("readiness: failed to get schema version", zap.String("error", err.Error()))
+		check("migrations", false, err.Error())
+	} else {
+		check("migrations", version == repository.SchemaVersion, fmt.Sprintf("version %d of %d", version, repository.SchemaVersion))
+	}
+
+	state := s.ls.BreakerState()
+	check("accrual", state != BreakerOpen, "circuit breaker "+state)
+
+	depth := len(s.orders)
+	check("orders_queue", depth < s.queueThreshold, fmt.Sprintf("%d queued, threshold %d", depth, s.queueThreshold))
+
+	status := "ready"
+	if !ready {
+		status = "not_ready"
+	}
+	return models.HealthResponse{Status: status, Checks: checks}, ready
+}
+
+func (s *Service) CloseEvents() {
+	s.events.Close()
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/ShiraazMoollatjie/goluhn"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+func (s *Service) holdsExpirer(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.expireHolds(context.Background())
+		}
+	}
+}
+
+func (s *Service) expireHolds(ctx context.Context) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.expireHolds")
+	defer span.End()
+
+	users, err := s.db.ExpireHolds(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to expire holds", zap.String("error", err.Error()))
+		return
+	}
+	for _, userID := range users {
+		s.publishBalance(ctx, userID)
+	}
+	if len(users) > 0 {
+		logger.FromContext(ctx).Info("expire holds", zap.Int("users", len(users)))
+	}
+}
+
+// CreateHold reserves points for req.TTL seconds, or the configured default when it is omitted.
+func (s *Service) CreateHold(ctx context.Context, userID string, req models.HoldRequest) (models.HoldRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.CreateHold")
+	defer span.End()
+
+	ttl := s.holdTTL
+	if req.TTL != 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	if req.Sum <= 0 || goluhn.Validate(req.Number) != nil || ttl <= 0 || ttl > s.holdMaxTTL {
+		return models.HoldRecord{}, myerrors.ErrInvalid
+	}
+
+	hold, err := s.db.CreateHold(ctx, userID, models.WithdrawRecord{Number: req.Number, Sum: req.Sum}, ttl)
+	if err != nil {
+		return models.HoldRecord{}, err
+	}
+	s.publishBalance(ctx, userID)
+	return hold, nil
+}
+
+func (s *Service) GetHolds(ctx context.Context, userID string, limit int) ([]models.HoldRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetHolds")
+	defer span.End()
+
+	return s.db.GetHolds(ctx, userID, limit)
+}
+
+func (s *Service) CaptureHold(ctx context.Context, userID string, id int64) (models.HoldRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.CaptureHold")
+	defer span.End()
+
+	hold, err := s.db.CaptureHold(ctx, userID, id)
+	if err != nil {
+		return models.HoldRecord{}, err
+	}
+	s.publishBalance(ctx, userID)
+	return hold, nil
+}
+
+func (s *Service) ReleaseHold(ctx context.Context, userID string, id int64) (models.HoldRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.ReleaseHold")
+	defer span.End()
+
+	hold, err := s.db.ReleaseHold(ctx, userID, id)
+	if err != nil {
+		return models.HoldRecord{}, err
+	}
+	s.publishBalance(ctx, userID)
+	return hold, nil
+}
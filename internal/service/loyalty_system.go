@@ -1,7 +1,9 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
@@ -9,68 +11,141 @@ import (
 
 	myerrors "github.com/rutkin/gofermart/internal/errors"
 	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/metrics"
 	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+const (
+	noContentRetryPeriod = 1 * time.Second
+	breakerThreshold     = 5
+	breakerCooldown      = 30 * time.Second
+)
+
 var myClient = &http.Client{Timeout: 10 * time.Second}
 
 func NewLoyaltySystem(address string) *LoyaltySystem {
-	return &LoyaltySystem{address, make(chan bool)}
+	return &LoyaltySystem{address, make(chan bool), newCircuitBreaker(breakerThreshold, breakerCooldown)}
 }
 
 type LoyaltySystem struct {
 	address     string
 	stopProcess chan bool
+	breaker     *circuitBreaker
+}
+
+func (ls *LoyaltySystem) BreakerState() string {
+	return ls.breaker.State()
 }
 
 func (ls *LoyaltySystem) Stop() {
-	ls.stopProcess <- true
+	close(ls.stopProcess)
 }
 
-func (ls *LoyaltySystem) GetOrdersInfo(orderNumber string) (models.LoyaltyOrderRecord, error) {
-	address := ls.address + "/api/orders/" + orderNumber
-	logger.Log.Info("get order info", zap.String("address", address))
-	var resp *http.Response
-loop:
+func accrualOutcome(statusCode int) string {
+	switch statusCode {
+	case http.StatusOK:
+		return "ok"
+	case http.StatusNoContent:
+		return "no_content"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	default:
+		return "error"
+	}
+}
+
+func (ls *LoyaltySystem) GetOrdersInfo(ctx context.Context, orderNumber string) (models.LoyaltyOrderRecord, error) {
 	for {
+		loyaltyOrder, retryAfter, err := ls.FetchOrderInfo(ctx, orderNumber)
+		if !errors.Is(err, myerrors.ErrNotFound) && !errors.Is(err, myerrors.ErrTooManyRequests) {
+			return loyaltyOrder, err
+		}
+
 		select {
 		case <-ls.stopProcess:
-			logger.Log.Info("stop process order", zap.String("number", orderNumber))
+			logger.FromContext(ctx).Info("stop process order", zap.String("number", orderNumber))
 			return models.LoyaltyOrderRecord{}, myerrors.ErrTimeout
-		default:
-			var err error
-			resp, err = myClient.Get(address)
-			if err != nil {
-				logger.Log.Error("failed to get order info from loyalty system", zap.String("error", err.Error()))
-				return models.LoyaltyOrderRecord{}, err
-			}
-			switch resp.StatusCode {
-			case http.StatusTooManyRequests:
-				timeout, err := strconv.Atoi(resp.Header.Get("Retry-After"))
-				if err != nil {
-					logger.Log.Error("failed to convert retry from header", zap.String("error", err.Error()))
-					return models.LoyaltyOrderRecord{}, myerrors.ErrInternal
-				}
-				time.Sleep(time.Duration(timeout) * time.Second)
-			case http.StatusNoContent:
-				logger.Log.Info("no content")
-				time.Sleep(1 * time.Second)
-			case http.StatusInternalServerError:
-				logger.Log.Error("internal server error")
-				return models.LoyaltyOrderRecord{}, myerrors.ErrInternal
-			default:
-				break loop
-			}
+		case <-time.After(retryAfter):
 		}
 	}
+}
 
-	var loyaltyOrder models.LoyaltyOrderRecord
-	if err := json.NewDecoder(resp.Body).Decode(&loyaltyOrder); err != nil {
-		logger.Log.Error("failed to decode loyalty order", zap.String("error", err.Error()))
-		body, _ := io.ReadAll(resp.Body)
-		logger.Log.Error("response", zap.String("body", string(body)))
+func (ls *LoyaltySystem) FetchOrderInfo(ctx context.Context, orderNumber string) (models.LoyaltyOrderRecord, time.Duration, error) {
+	address := ls.address + "/api/orders/" + orderNumber
+	logger.FromContext(ctx).Info("get order info", zap.String("address", address))
+
+	if !ls.breaker.Allow() {
+		metrics.AccrualRequests.WithLabelValues("circuit_open").Inc()
+		logger.FromContext(ctx).Info("accrual circuit breaker is open", zap.String("number", orderNumber))
+		return models.LoyaltyOrderRecord{}, 0, myerrors.ErrUnavailable
+	}
+
+	ctx, span := tracing.Tracer.Start(ctx, "GET /api/orders/{number}",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", http.MethodGet), attribute.String("http.url", address)))
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		tracing.RecordError(span, err)
+		ls.breaker.Failure()
+		logger.FromContext(ctx).Error("failed to create loyalty system request", zap.String("error", err.Error()))
+		return models.LoyaltyOrderRecord{}, 0, err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := myClient.Do(req)
+	metrics.AccrualDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		tracing.RecordError(span, err)
+		ls.breaker.Failure()
+		metrics.AccrualRequests.WithLabelValues("error").Inc()
+		logger.FromContext(ctx).Error("failed to get order info from loyalty system", zap.String("error", err.Error()))
+		return models.LoyaltyOrderRecord{}, 0, err
 	}
 	defer resp.Body.Close()
-	return loyaltyOrder, nil
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	metrics.AccrualRequests.WithLabelValues(accrualOutcome(resp.StatusCode)).Inc()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		ls.breaker.Failure()
+	} else {
+		ls.breaker.Success()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		timeout, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			logger.FromContext(ctx).Error("failed to convert retry from header", zap.String("error", err.Error()))
+			return models.LoyaltyOrderRecord{}, 0, myerrors.ErrInternal
+		}
+		return models.LoyaltyOrderRecord{}, time.Duration(timeout) * time.Second, myerrors.ErrTooManyRequests
+	case http.StatusNoContent:
+		logger.FromContext(ctx).Info("no content")
+		return models.LoyaltyOrderRecord{}, noContentRetryPeriod, myerrors.ErrNotFound
+	default:
+		logger.FromContext(ctx).Error("internal server error", zap.Int("status", resp.StatusCode))
+		return models.LoyaltyOrderRecord{}, 0, myerrors.ErrInternal
+	}
+
+	var loyaltyOrder models.LoyaltyOrderRecord
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to read loyalty order", zap.String("error", err.Error()))
+		return models.LoyaltyOrderRecord{}, 0, err
+	}
+	if err := json.Unmarshal(body, &loyaltyOrder); err != nil {
+		logger.FromContext(ctx).Error("failed to decode loyalty order", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("response", zap.String("body", string(body)))
+		return models.LoyaltyOrderRecord{}, 0, err
+	}
+	return loyaltyOrder, 0, nil
 }
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"strconv"
+	"time"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/events"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const accrualCallbackMaxAge = 5 * time.Minute
+
+var accrualStatuses = map[string]string{
+	"REGISTERED":           models.OrderProcessing,
+	models.OrderProcessing: models.OrderProcessing,
+	models.OrderInvalid:    models.OrderInvalid,
+	models.OrderProcessed:  models.OrderProcessed,
+}
+
+var orderTransitions = map[string][]string{
+	models.OrderNew:        {models.OrderProcessing, models.OrderInvalid, models.OrderProcessed},
+	models.OrderProcessing: {models.OrderInvalid, models.OrderProcessed},
+}
+
+func canTransition(from string, to string) bool {
+	for _, status := range orderTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) applyOrderStatus(ctx context.Context, userID string, orderNumber string, status string, accrual float32) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.applyOrderStatus")
+	defer span.End()
+
+	currentUserID, currentStatus, err := s.db.GetOrderState(ctx, orderNumber)
+	if err != nil {
+		return err
+	}
+	if userID != "" && userID != currentUserID {
+		return myerrors.ErrConflict
+	}
+
+	if currentStatus == status {
+		return nil
+	}
+	if !canTransition(currentStatus, status) {
+		logger.FromContext(ctx).Info("skip order transition", zap.String("number", orderNumber), zap.String("from", currentStatus), zap.String("to", status))
+		return myerrors.ErrConflict
+	}
+
+	err = s.db.UpdateOrder(ctx, currentUserID, orderNumber, currentStatus, status, accrual)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to update order", zap.String("number", orderNumber), zap.String("error", err.Error()))
+		return err
+	}
+	logger.FromContext(ctx).Info("update order", zap.String("userID", currentUserID), zap.String("number", orderNumber), zap.String("status", status), zap.Float32("accrual", accrual))
+	s.events.Publish(currentUserID, events.OrderEvent, models.OrderStatusRecord{Number: orderNumber, Status: status, Accrual: accrual})
+	s.publishBalance(ctx, currentUserID)
+	return nil
+}
+
+func (s *Service) applyAccrual(ctx context.Context, userID string, orderInfo models.LoyaltyOrderRecord) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.applyAccrual")
+	defer span.End()
+
+	status, ok := accrualStatuses[orderInfo.Status]
+	if !ok {
+		logger.FromContext(ctx).Error("unknown accrual status", zap.String("number", orderInfo.Number), zap.String("status", orderInfo.Status))
+		return myerrors.ErrInvalid
+	}
+
+	var accrual float32
+	if status == models.OrderProcessed {
+		accrual = orderInfo.Accrual
+	}
+	return s.applyOrderStatus(ctx, userID, orderInfo.Number, status, accrual)
+}
+
+func (s *Service) AccrualCallbackEnabled() bool {
+	return s.callbackSecret != ""
+}
+
+// VerifyAccrualSignature checks the callback is signed like webhooks, over "<timestamp>.<body>",
+// and was sent recently so a captured callback can't be replayed later.
+func (s *Service) VerifyAccrualSignature(body []byte, timestamp string, signature string) bool {
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > accrualCallbackMaxAge || age < -accrualCallbackMaxAge {
+		return false
+	}
+	return hmac.Equal([]byte(SignWebhook(s.callbackSecret, timestamp, body)), []byte(signature))
+}
+
+func (s *Service) ApplyAccrualCallback(ctx context.Context, orderInfo models.LoyaltyOrderRecord) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.ApplyAccrualCallback")
+	defer span.End()
+
+	err := s.applyAccrual(ctx, "", orderInfo)
+	if errors.Is(err, myerrors.ErrConflict) {
+		logger.FromContext(ctx).Info("ignore accrual callback", zap.String("number", orderInfo.Number), zap.String("status", orderInfo.Status))
+	}
+	return err
+}
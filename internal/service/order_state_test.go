@@ -0,0 +1,93 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/models"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want bool
+	}{
+		{models.OrderNew, models.OrderProcessing, true},
+		{models.OrderNew, models.OrderInvalid, true},
+		{models.OrderNew, models.OrderProcessed, true},
+		{models.OrderProcessing, models.OrderInvalid, true},
+		{models.OrderProcessing, models.OrderProcessed, true},
+		{models.OrderProcessing, models.OrderNew, false},
+		{models.OrderProcessed, models.OrderProcessing, false},
+		{models.OrderProcessed, models.OrderInvalid, false},
+		{models.OrderInvalid, models.OrderProcessed, false},
+		{models.OrderInvalid, models.OrderProcessing, false},
+		{models.OrderNew, models.OrderNew, false},
+		{"UNKNOWN", models.OrderProcessed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			if got := canTransition(tt.from, tt.to); got != tt.want {
+				t.Fatalf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccrualStatuses(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+		ok     bool
+	}{
+		{"REGISTERED", models.OrderProcessing, true},
+		{"PROCESSING", models.OrderProcessing, true},
+		{"INVALID", models.OrderInvalid, true},
+		{"PROCESSED", models.OrderProcessed, true},
+		{"NEW", "", false},
+		{"processed", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			got, ok := accrualStatuses[tt.status]
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("accrualStatuses[%s] = %q, %v, want %q, %v", tt.status, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerifyAccrualSignature(t *testing.T) {
+	s := &Service{callbackSecret: "secret"}
+	body := []byte(`{"order":"12345678903","status":"PROCESSED","accrual":500}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-2*accrualCallbackMaxAge).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(2*accrualCallbackMaxAge).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		body      []byte
+		timestamp string
+		signature string
+		want      bool
+	}{
+		{"valid", body, now, SignWebhook("secret", now, body), true},
+		{"other secret", body, now, SignWebhook("other", now, body), false},
+		{"tampered body", []byte(`{"order":"12345678903","status":"PROCESSED","accrual":5000}`), now, SignWebhook("secret", now, body), false},
+		{"timestamp not signed", body, now, SignWebhook("secret", stale, body), false},
+		{"replayed", body, stale, SignWebhook("secret", stale, body), false},
+		{"from the future", body, future, SignWebhook("secret", future, body), false},
+		{"missing timestamp", body, "", SignWebhook("secret", "", body), false},
+		{"missing signature", body, now, "", false},
+		{"signature without prefix", body, now, SignWebhook("secret", now, body)[len("sha256="):], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.VerifyAccrualSignature(tt.body, tt.timestamp, tt.signature); got != tt.want {
+				t.Fatalf("VerifyAccrualSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+func (s *Service) reconciler(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.Reconcile(context.Background(), false)
+		}
+	}
+}
+
+func (s *Service) Reconcile(ctx context.Context, fix bool) ([]models.BalanceDiscrepancy, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.Reconcile")
+	defer span.End()
+
+	discrepancies, err := s.db.Reconcile(ctx, fix)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to reconcile balances", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	for _, item := range discrepancies {
+		logger.FromContext(ctx).Warn("balance discrepancy",
+			zap.String("userID", item.UserID),
+			zap.Float32("current", item.Current),
+			zap.Float32("expectedCurrent", item.ExpectedCurrent),
+			zap.Float32("withdrawn", item.Withdrawn),
+			zap.Float32("expectedWithdrawn", item.ExpectedWithdrawn),
+			zap.Bool("fixed", item.Fixed))
+	}
+	logger.FromContext(ctx).Info("reconcile balances", zap.Int("discrepancies", len(discrepancies)), zap.Bool("fix", fix))
+	return discrepancies, nil
+}
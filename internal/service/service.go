@@ -1,14 +1,24 @@
 package service
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"sync"
+	"time"
 
+	"github.com/ShiraazMoollatjie/goluhn"
 	"github.com/rutkin/gofermart/internal/config"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/events"
 	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/metrics"
 	"github.com/rutkin/gofermart/internal/models"
 	"github.com/rutkin/gofermart/internal/repository"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -17,14 +27,80 @@ func NewService(config *config.Config) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
+	db.SetPendingPeriod(config.PointsPendingPeriod)
+	db.SetPointsExpiry(config.PointsTTL, config.PointsExpiryNotice)
 	ls := NewLoyaltySystem(config.AccrualSystemAddress)
-	return &Service{db, ls, sync.WaitGroup{}}, nil
+	s := &Service{
+		db:               db,
+		ls:               ls,
+		orders:           make(chan orderTask, config.OrdersQueueSize),
+		inFlight:         make(map[string]struct{}),
+		done:             make(chan struct{}),
+		events:           events.NewBroker(eventsLogSize),
+		callbackSecret:   config.AccrualCallbackSecret,
+		stuckOrderAge:    config.StuckOrderAge,
+		orderMaxAttempts: config.OrderMaxAttempts,
+		queueThreshold:   config.ReadinessQueueThreshold,
+		holdTTL:          config.HoldTTL,
+		holdMaxTTL:       config.HoldMaxTTL,
+		transferLimits: repository.TransferLimits{
+			Amount: float32(config.TransferDailyAmount),
+			Count:  config.TransferDailyCount,
+		},
+	}
+	metrics.RegisterStore(db)
+	metrics.RegisterQueueDepth(func() float64 { return float64(len(s.orders)) })
+	s.SetOrdersWorkers(config.OrdersWorkers)
+	s.wg.Add(1)
+	go s.webhooksWorker()
+	if config.SweepInterval > 0 {
+		s.wg.Add(1)
+		go s.sweeper(config.SweepInterval)
+	}
+	if config.ReconcileInterval > 0 {
+		s.wg.Add(1)
+		go s.reconciler(config.ReconcileInterval)
+	}
+	if config.PointsTTL > 0 && config.PointsExpiryInterval > 0 {
+		s.wg.Add(1)
+		go s.pointsExpirer(config.PointsExpiryInterval)
+	}
+	if config.HoldExpireInterval > 0 {
+		s.wg.Add(1)
+		go s.holdsExpirer(config.HoldExpireInterval)
+	}
+	return s, nil
+}
+
+const eventsLogSize = 1000
+
+type orderTask struct {
+	userID string
+	number string
+	once   bool
+	link   trace.SpanContext
+	log    *zap.Logger
 }
 
 type Service struct {
-	db *repository.Database
-	ls *LoyaltySystem
-	wg sync.WaitGroup
+	db             *repository.Database
+	ls             *LoyaltySystem
+	wg             sync.WaitGroup
+	orders         chan orderTask
+	inFlightMutex  sync.Mutex
+	inFlight       map[string]struct{}
+	workersMutex   sync.Mutex
+	workers        []chan struct{}
+	done           chan struct{}
+	events         *events.Broker
+	callbackSecret string
+
+	stuckOrderAge    time.Duration
+	orderMaxAttempts int
+	queueThreshold   int
+	holdTTL          time.Duration
+	holdMaxTTL       time.Duration
+	transferLimits   repository.TransferLimits
 }
 
 func calculateHash(value string) string {
@@ -33,43 +109,264 @@ func calculateHash(value string) string {
 	return base64.URLEncoding.EncodeToString(h.Sum(nil))
 }
 
-func (s *Service) processOrder(userID string, orderNumber string) {
+// SetOrdersWorkers starts or stops orders workers so that count of them are running.
+func (s *Service) SetOrdersWorkers(count int) {
+	s.workersMutex.Lock()
+	defer s.workersMutex.Unlock()
+	for len(s.workers) < count {
+		stop := make(chan struct{})
+		s.workers = append(s.workers, stop)
+		s.wg.Add(1)
+		go s.ordersWorker(stop)
+	}
+	for len(s.workers) > count {
+		last := len(s.workers) - 1
+		close(s.workers[last])
+		s.workers = s.workers[:last]
+	}
+}
+
+func (s *Service) ApplyConfig(config *config.Config) {
+	s.workersMutex.Lock()
+	current := len(s.workers)
+	s.workersMutex.Unlock()
+	if current != config.OrdersWorkers {
+		logger.Log.Info("changing orders workers count", zap.Int("from", current), zap.Int("to", config.OrdersWorkers))
+		s.SetOrdersWorkers(config.OrdersWorkers)
+	}
+}
+
+func (s *Service) ordersWorker(stop chan struct{}) {
 	defer s.wg.Done()
-	s.db.UpdateOrder(userID, orderNumber, "PROCESSING", 0)
-	orderInfo, err := s.ls.GetOrdersInfo(orderNumber)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-stop:
+			return
+		case task := <-s.orders:
+			s.processOrder(task)
+			s.releaseOrder(task.number)
+		}
+	}
+}
+
+func (s *Service) acquireOrder(orderNumber string) bool {
+	s.inFlightMutex.Lock()
+	defer s.inFlightMutex.Unlock()
+	if _, ok := s.inFlight[orderNumber]; ok {
+		return false
+	}
+	s.inFlight[orderNumber] = struct{}{}
+	return true
+}
+
+func (s *Service) orderInFlight(orderNumber string) bool {
+	s.inFlightMutex.Lock()
+	defer s.inFlightMutex.Unlock()
+	_, ok := s.inFlight[orderNumber]
+	return ok
+}
+
+func (s *Service) releaseOrder(orderNumber string) {
+	s.inFlightMutex.Lock()
+	defer s.inFlightMutex.Unlock()
+	delete(s.inFlight, orderNumber)
+}
+
+// enqueueOrder never blocks, when the queue is full the order stays NEW for the sweeper to pick up.
+func (s *Service) enqueueOrder(task orderTask) bool {
+	if !s.acquireOrder(task.number) {
+		return false
+	}
+
+	select {
+	case s.orders <- task:
+		return true
+	default:
+		if !task.once {
+			logger.Log.Info("orders queue is full, leaving order to sweeper", zap.String("number", task.number))
+		}
+		s.releaseOrder(task.number)
+		return false
+	}
+}
+
+func (s *Service) submitOrder(ctx context.Context, userID string, orderNumber string) {
+	if s.AccrualCallbackEnabled() {
+		return
+	}
+	s.enqueueOrder(orderTask{userID: userID, number: orderNumber, link: trace.SpanContextFromContext(ctx), log: logger.FromContext(ctx)})
+}
+
+func (s *Service) processOrder(task orderTask) {
+	ctx, span := tracing.Tracer.Start(context.Background(), "Service.processOrder",
+		trace.WithLinks(trace.Link{SpanContext: task.link}),
+		trace.WithAttributes(attribute.String("order.number", task.number), attribute.Bool("order.once", task.once)))
+	defer span.End()
+
+	if task.log != nil {
+		ctx = logger.WithContext(ctx, task.log)
+	}
+	ctx = logger.With(ctx, zap.String("userID", task.userID), zap.String("number", task.number))
+
+	s.applyOrderStatus(ctx, task.userID, task.number, models.OrderProcessing, 0)
+
+	var orderInfo models.LoyaltyOrderRecord
+	var err error
+	if task.once {
+		orderInfo, _, err = s.ls.FetchOrderInfo(ctx, task.number)
+	} else {
+		orderInfo, err = s.ls.GetOrdersInfo(ctx, task.number)
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.FromContext(ctx).Error("failed to get order info from loyalty system", zap.String("error", err.Error()))
+		return
+	}
+
+	s.applyAccrual(ctx, task.userID, orderInfo)
+}
+
+func (s *Service) publishBalance(ctx context.Context, userID string) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.publishBalance")
+	defer span.End()
+
+	balance, err := s.db.GetBalance(ctx, userID)
 	if err != nil {
-		logger.Log.Error("failed to get order info from loyalty system", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("failed to get balance for event", zap.String("error", err.Error()))
 		return
 	}
-	logger.Log.Info("update order", zap.String("userID", userID), zap.String("number", orderInfo.Number), zap.String("syayus", orderInfo.Status), zap.Float32("accrual", orderInfo.Accrual))
-	s.db.UpdateOrder(userID, orderInfo.Number, orderInfo.Status, orderInfo.Accrual)
+	s.events.Publish(userID, events.BalanceEvent, balance)
+}
+
+func (s *Service) SubscribeEvents(ctx context.Context, userID string, lastEventID uint64) ([]events.Event, <-chan events.Event, func()) {
+	sub := s.events.Subscribe(userID, lastEventID)
+	if sub.Resync {
+		return s.eventsSnapshot(ctx, userID, sub.LastID), sub.Events, sub.Cancel
+	}
+	return sub.Backlog, sub.Events, sub.Cancel
+}
+
+// eventsSnapshot describes the current state of the user as events for a subscriber whose missed
+// events can't be replayed.
+func (s *Service) eventsSnapshot(ctx context.Context, userID string, id uint64) []events.Event {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.eventsSnapshot")
+	defer span.End()
+
+	var snapshot []events.Event
+	orders, err := s.db.GetOrders(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to get orders for events snapshot", zap.String("error", err.Error()))
+	}
+	for _, order := range orders {
+		status := models.OrderStatusRecord{Number: order.Number, Status: order.Status, Accrual: order.Accrual}
+		if event, err := events.NewEvent(id, userID, events.OrderEvent, status); err == nil {
+			snapshot = append(snapshot, event)
+		}
+	}
+
+	balance, err := s.db.GetBalance(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to get balance for events snapshot", zap.String("error", err.Error()))
+		return snapshot
+	}
+	if event, err := events.NewEvent(id, userID, events.BalanceEvent, balance); err == nil {
+		snapshot = append(snapshot, event)
+	}
+	return snapshot
 }
 
 func (s *Service) Close() {
+	close(s.done)
 	s.ls.Stop()
 	s.wg.Wait()
 }
 
-func (s *Service) RegisterUser(username string, password string) (string, error) {
-	return s.db.CreateUser(username, calculateHash(password))
+func (s *Service) RegisterUser(ctx context.Context, username string, password string) (string, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.RegisterUser")
+	defer span.End()
+
+	userID, err := s.db.CreateUser(ctx, username, calculateHash(password))
+	if err == nil {
+		metrics.Registrations.Inc()
+	}
+	return userID, err
 }
 
-func (s *Service) Login(username string, password string) (string, error) {
-	return s.db.GetUserID(username, calculateHash(password))
+func (s *Service) Login(ctx context.Context, username string, password string) (string, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.Login")
+	defer span.End()
+
+	return s.db.GetUserID(ctx, username, calculateHash(password))
 }
 
-func (s *Service) CreateOrder(userID string, orderNumber string) error {
-	logger.Log.Info("create order", zap.String("number", orderNumber))
-	err := s.db.CreateOrder(userID, orderNumber)
+func (s *Service) CreateOrder(ctx context.Context, userID string, orderNumber string) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.CreateOrder")
+	defer span.End()
+
+	logger.FromContext(ctx).Info("create order", zap.String("number", orderNumber))
+	err := s.db.CreateOrder(ctx, userID, orderNumber)
 	if err == nil {
-		s.wg.Add(1)
-		go s.processOrder(userID, orderNumber)
+		metrics.OrdersCreated.Inc()
+		s.submitOrder(ctx, userID, orderNumber)
 	}
 	return err
 }
 
-func (s *Service) GetOrders(userID string) (models.OrdersResponse, error) {
-	orders, err := s.db.GetOrders(userID)
+func (s *Service) CreateOrders(ctx context.Context, userID string, numbers []string) ([]models.BatchOrderRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.CreateOrders")
+	defer span.End()
+
+	result := make([]models.BatchOrderRecord, len(numbers))
+	seen := make(map[string]bool, len(numbers))
+	var valid []string
+	for i, number := range numbers {
+		result[i].Number = number
+		if err := goluhn.Validate(number); err != nil {
+			result[i].Result = models.BatchOrderInvalid
+			continue
+		}
+		if !seen[number] {
+			seen[number] = true
+			valid = append(valid, number)
+		}
+	}
+
+	if len(valid) == 0 {
+		return result, nil
+	}
+
+	created, err := s.db.CreateOrders(ctx, userID, valid)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		if result[i].Result != "" {
+			continue
+		}
+		err, ok := created[result[i].Number]
+		switch {
+		case !ok || errors.Is(err, myerrors.ErrExists):
+			result[i].Result = models.BatchOrderUploaded
+		case errors.Is(err, myerrors.ErrConflict):
+			result[i].Result = models.BatchOrderConflict
+		default:
+			result[i].Result = models.BatchOrderAccepted
+			delete(created, result[i].Number)
+			metrics.OrdersCreated.Inc()
+			s.submitOrder(ctx, userID, result[i].Number)
+		}
+	}
+	return result, nil
+}
+
+func (s *Service) GetOrders(ctx context.Context, userID string) (models.OrdersResponse, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetOrders")
+	defer span.End()
+
+	orders, err := s.db.GetOrders(ctx, userID)
 	if err != nil {
 		return models.OrdersResponse{}, err
 	}
@@ -77,23 +374,106 @@ func (s *Service) GetOrders(userID string) (models.OrdersResponse, error) {
 	return orders, nil
 }
 
-func (s *Service) GetBalance(userID string) (models.BalanceRecord, error) {
-	return s.db.GetBalance(userID)
+func (s *Service) GetOrder(ctx context.Context, userID string, number string) (models.OrderResponse, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetOrder")
+	defer span.End()
+
+	order, err := s.db.GetOrder(ctx, userID, number)
+	if err != nil {
+		return models.OrderResponse{}, err
+	}
+
+	history, err := s.db.GetOrderHistory(ctx, number)
+	if err != nil {
+		return models.OrderResponse{}, err
+	}
+
+	return models.OrderResponse{OrderRecord: order, History: history}, nil
+}
+
+func (s *Service) GetOrdersStatus(ctx context.Context, userID string, numbers []string) ([]models.OrderStatusRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetOrdersStatus")
+	defer span.End()
+
+	orders, err := s.db.GetOrdersStatus(ctx, userID, numbers)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]models.OrderRecord, len(orders))
+	for _, order := range orders {
+		found[order.Number] = order
+	}
+
+	result := make([]models.OrderStatusRecord, 0, len(numbers))
+	for _, number := range numbers {
+		order, ok := found[number]
+		if !ok {
+			result = append(result, models.OrderStatusRecord{Number: number, Status: "NOT_FOUND"})
+			continue
+		}
+		result = append(result, models.OrderStatusRecord{Number: order.Number, Status: order.Status, Accrual: order.Accrual})
+	}
+	return result, nil
 }
 
-func (s *Service) Withdraw(userID string, rec models.WithdrawRecord) error {
-	err := s.db.Withdraw(userID, rec)
+func (s *Service) GetBalance(ctx context.Context, userID string) (models.BalanceRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetBalance")
+	defer span.End()
+
+	return s.db.GetBalance(ctx, userID)
+}
+
+func (s *Service) Withdraw(ctx context.Context, userID string, rec models.WithdrawRecord) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.Withdraw")
+	defer span.End()
+
+	if rec.Sum <= 0 || goluhn.Validate(rec.Number) != nil {
+		metrics.Withdrawals.WithLabelValues("invalid").Inc()
+		return myerrors.ErrInvalid
+	}
+
+	err := s.db.Withdraw(ctx, userID, rec)
 	if err != nil {
-		logger.Log.Error("failed to withdraw", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Error("failed to withdraw", zap.String("error", err.Error()))
+		switch {
+		case errors.Is(err, myerrors.ErrNotEnoughtMoney):
+			metrics.Withdrawals.WithLabelValues("not_enough_money").Inc()
+		case errors.Is(err, myerrors.ErrDebt):
+			metrics.Withdrawals.WithLabelValues("debt").Inc()
+		default:
+			metrics.Withdrawals.WithLabelValues("error").Inc()
+		}
+		return err
 	}
+	metrics.Withdrawals.WithLabelValues("success").Inc()
+	s.publishBalance(ctx, userID)
 	return nil
 }
 
-func (s *Service) GetWithdrawals(userID string) ([]models.WithdrawalResponse, error) {
-	res, err := s.db.GetWithdrawals(userID)
+func (s *Service) GetBalanceHistory(ctx context.Context, userID string, limit int) ([]models.BalanceHistoryRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetBalanceHistory")
+	defer span.End()
+
+	return s.db.GetBalanceHistory(ctx, userID, limit)
+}
+
+func (s *Service) GetWithdrawals(ctx context.Context, userID string) ([]models.WithdrawalResponse, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetWithdrawals")
+	defer span.End()
+
+	res, err := s.db.GetWithdrawals(ctx, userID)
 	if err != nil {
-		logger.Log.Info("failed to withdrawals", zap.String("error", err.Error()))
+		logger.FromContext(ctx).Info("failed to withdrawals", zap.String("error", err.Error()))
 		return []models.WithdrawalResponse{}, err
 	}
 	return res, nil
 }
+
+func (s *Service) TakeRateLimitToken(ctx context.Context, key string, rate float64, burst int) (bool, float64, error) {
+	return s.db.TakeRateLimitToken(ctx, key, rate, burst)
+}
+
+func (s *Service) DeleteStaleRateLimits(ctx context.Context, olderThan time.Duration) error {
+	return s.db.DeleteStaleRateLimits(ctx, olderThan)
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/metrics"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const sweepLimit = 100
+
+type sweepStats struct {
+	found     int
+	enqueued  int
+	skipped   int
+	exhausted int
+}
+
+func (s *Service) sweeper(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sweepOrders(context.Background())
+		}
+	}
+}
+
+func (s *Service) sweepOrders(ctx context.Context) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.sweepOrders")
+	defer span.End()
+
+	orders, err := s.db.GetUnprocessedOrders(ctx, s.stuckOrderAge, sweepLimit)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to get stuck orders", zap.String("error", err.Error()))
+		return
+	}
+
+	stats := sweepStats{found: len(orders)}
+	for _, order := range orders {
+		// with callbacks the order may still be waiting for its push, so polling never gives up on it
+		if order.Attempts >= s.orderMaxAttempts && !s.AccrualCallbackEnabled() {
+			logger.FromContext(ctx).Info("order exhausted retry budget", zap.String("number", order.Number), zap.Int("attempts", order.Attempts))
+			if err := s.applyOrderStatus(ctx, order.UserID, order.Number, models.OrderInvalid, 0); err != nil {
+				logger.FromContext(ctx).Error("failed to invalidate stuck order", zap.String("number", order.Number), zap.String("error", err.Error()))
+				continue
+			}
+			stats.exhausted++
+			continue
+		}
+
+		if !s.enqueueOrder(orderTask{userID: order.UserID, number: order.Number, once: true, link: trace.SpanContextFromContext(ctx), log: logger.FromContext(ctx)}) {
+			stats.skipped++
+			continue
+		}
+		if err := s.db.IncrementOrderAttempts(ctx, order.Number); err != nil {
+			logger.FromContext(ctx).Error("failed to increment order attempts", zap.String("number", order.Number), zap.String("error", err.Error()))
+		}
+		stats.enqueued++
+	}
+
+	metrics.SweptOrders.WithLabelValues("enqueued").Add(float64(stats.enqueued))
+	metrics.SweptOrders.WithLabelValues("skipped").Add(float64(stats.skipped))
+	metrics.SweptOrders.WithLabelValues("exhausted").Add(float64(stats.exhausted))
+	logger.FromContext(ctx).Info("sweep stuck orders",
+		zap.Int("found", stats.found),
+		zap.Int("enqueued", stats.enqueued),
+		zap.Int("skipped", stats.skipped),
+		zap.Int("exhausted", stats.exhausted))
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/metrics"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const maxIdempotencyKeyLen = 100
+
+// Transfer moves points to another user, repeated calls with the same key return the first transfer.
+func (s *Service) Transfer(ctx context.Context, userID string, key string, req models.TransferRequest) (models.TransferRecord, bool, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.Transfer")
+	defer span.End()
+
+	req.Login = strings.TrimSpace(req.Login)
+	sum := float64(req.Sum)
+	if key == "" || len(key) > maxIdempotencyKeyLen || req.Login == "" || sum <= 0 || math.IsInf(sum, 0) || math.IsNaN(sum) {
+		metrics.Transfers.WithLabelValues("invalid").Inc()
+		return models.TransferRecord{}, false, myerrors.ErrInvalid
+	}
+
+	rec, replayed, err := s.db.Transfer(ctx, userID, key, req, s.transferLimits)
+	if err != nil {
+		switch {
+		case errors.Is(err, myerrors.ErrInvalid):
+			metrics.Transfers.WithLabelValues("invalid").Inc()
+		case errors.Is(err, myerrors.ErrNotFound):
+			metrics.Transfers.WithLabelValues("unknown_recipient").Inc()
+		case errors.Is(err, myerrors.ErrNotEnoughtMoney):
+			metrics.Transfers.WithLabelValues("not_enough_money").Inc()
+		case errors.Is(err, myerrors.ErrDebt):
+			metrics.Transfers.WithLabelValues("debt").Inc()
+		case errors.Is(err, myerrors.ErrLimitExceeded):
+			metrics.Transfers.WithLabelValues("limit_exceeded").Inc()
+		case errors.Is(err, myerrors.ErrConflict):
+			metrics.Transfers.WithLabelValues("key_reused").Inc()
+		default:
+			logger.FromContext(ctx).Error("failed to transfer", zap.String("error", err.Error()))
+			metrics.Transfers.WithLabelValues("error").Inc()
+		}
+		return models.TransferRecord{}, false, err
+	}
+	if replayed {
+		metrics.Transfers.WithLabelValues("replayed").Inc()
+		return rec, true, nil
+	}
+
+	metrics.Transfers.WithLabelValues("success").Inc()
+	s.publishBalance(ctx, userID)
+	s.publishBalance(ctx, rec.ToUserID)
+	return rec, false, nil
+}
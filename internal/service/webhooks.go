@@ -0,0 +1,278 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	myerrors "github.com/rutkin/gofermart/internal/errors"
+	"github.com/rutkin/gofermart/internal/logger"
+	"github.com/rutkin/gofermart/internal/models"
+	"github.com/rutkin/gofermart/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookPollPeriod  = time.Second
+	webhookBatchSize   = 20
+	webhookLease       = time.Minute
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 5 * time.Second
+	webhookMaxBackoff  = time.Hour
+)
+
+const (
+	WebhookEventHeader     = "X-Gofermart-Event"
+	WebhookDeliveryHeader  = "X-Gofermart-Delivery"
+	WebhookTimestampHeader = "X-Gofermart-Timestamp"
+	WebhookSignatureHeader = "X-Gofermart-Signature"
+)
+
+var errBlockedAddress = errors.New("webhook address is not allowed")
+
+var webhookDialer = &net.Dialer{
+	Timeout: 5 * time.Second,
+	// Control sees the address actually dialed, so a host resolving to an internal address
+	// after the webhook was validated is still refused
+	Control: func(network string, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+			return errBlockedAddress
+		}
+		return nil
+	},
+}
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         webhookDialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// blockedIP reports whether webhooks must not be sent to the address, as it belongs to the host
+// itself or an internal network.
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func SendWebhook(ctx context.Context, client *http.Client, delivery models.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func generateSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+func validateWebhookRequest(ctx context.Context, req models.WebhookRequest) error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return myerrors.ErrInvalid
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		logger.FromContext(ctx).Info("failed to resolve webhook host", zap.String("error", err.Error()))
+		return myerrors.ErrInvalid
+	}
+	for _, addr := range addrs {
+		if blockedIP(addr.IP) {
+			return myerrors.ErrInvalid
+		}
+	}
+
+	for _, event := range req.Events {
+		if event != models.WebhookOrderProcessed && event != models.WebhookWithdrawalCreated && event != models.WebhookWithdrawalRefunded {
+			return myerrors.ErrInvalid
+		}
+	}
+	return nil
+}
+
+func (s *Service) webhooksWorker() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(webhookPollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.deliverWebhooks(context.Background())
+		}
+	}
+}
+
+type webhookDeliveryStore interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	CompleteWebhookDelivery(ctx context.Context, id int64) error
+	FailWebhookDelivery(ctx context.Context, id int64, deliveryErr string, retryAfter time.Duration, dead bool) error
+}
+
+func (s *Service) deliverWebhooks(ctx context.Context) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.deliverWebhooks")
+	defer span.End()
+
+	deliverWebhookBatch(ctx, s.db, webhookClient)
+}
+
+// deliverWebhookBatch sends claimed deliveries, scheduling failed ones for a retry with backoff
+// until they run out of attempts and become dead.
+func deliverWebhookBatch(ctx context.Context, store webhookDeliveryStore, client *http.Client) {
+	deliveries, err := store.ClaimWebhookDeliveries(ctx, webhookBatchSize, webhookLease)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to claim webhook deliveries", zap.String("error", err.Error()))
+		return
+	}
+
+	for _, delivery := range deliveries {
+		err := SendWebhook(ctx, client, delivery)
+		if err == nil {
+			logger.FromContext(ctx).Info("webhook delivered", zap.Int64("id", delivery.ID), zap.String("event", delivery.Event))
+			if err := store.CompleteWebhookDelivery(ctx, delivery.ID); err != nil {
+				logger.FromContext(ctx).Error("failed to complete webhook delivery", zap.Int64("id", delivery.ID), zap.String("error", err.Error()))
+			}
+			continue
+		}
+
+		attempts := delivery.Attempts + 1
+		dead := attempts >= webhookMaxAttempts
+		logger.FromContext(ctx).Error("failed to deliver webhook", zap.Int64("id", delivery.ID), zap.Int("attempts", attempts), zap.Bool("dead", dead), zap.String("error", err.Error()))
+		if err := store.FailWebhookDelivery(ctx, delivery.ID, err.Error(), webhookBackoff(attempts), dead); err != nil {
+			logger.FromContext(ctx).Error("failed to record webhook delivery failure", zap.Int64("id", delivery.ID), zap.String("error", err.Error()))
+		}
+	}
+}
+
+func (s *Service) CreateWebhook(ctx context.Context, userID string, req models.WebhookRequest) (models.WebhookRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.CreateWebhook")
+	defer span.End()
+
+	rec, err := newWebhook(ctx, req)
+	if err != nil {
+		return models.WebhookRecord{}, err
+	}
+	return rec, s.db.CreateWebhook(ctx, userID, rec)
+}
+
+func newWebhook(ctx context.Context, req models.WebhookRequest) (models.WebhookRecord, error) {
+	if err := validateWebhookRequest(ctx, req); err != nil {
+		return models.WebhookRecord{}, err
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to generate webhook secret", zap.String("error", err.Error()))
+		return models.WebhookRecord{}, err
+	}
+
+	rec := models.WebhookRecord{
+		ID:        uuid.New().String(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if rec.Events == nil {
+		rec.Events = []string{}
+	}
+	return rec, nil
+}
+
+func (s *Service) GetWebhooks(ctx context.Context, userID string) ([]models.WebhookRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetWebhooks")
+	defer span.End()
+
+	return s.db.GetWebhooks(ctx, userID)
+}
+
+func (s *Service) DeleteWebhook(ctx context.Context, userID string, id string) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.DeleteWebhook")
+	defer span.End()
+
+	return s.db.DeleteWebhook(ctx, userID, id)
+}
+
+func (s *Service) GetWebhookDeliveries(ctx context.Context, userID string, webhookID string) ([]models.WebhookDeliveryRecord, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.GetWebhookDeliveries")
+	defer span.End()
+
+	return s.db.GetWebhookDeliveries(ctx, userID, webhookID)
+}
+
+func (s *Service) RedeliverWebhook(ctx context.Context, userID string, deliveryID int64) error {
+	ctx, span := tracing.Tracer.Start(ctx, "Service.RedeliverWebhook")
+	defer span.End()
+
+	return s.db.RedeliverWebhook(ctx, userID, deliveryID)
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rutkin/gofermart/internal/models"
+)
+
+type failedDelivery struct {
+	id         int64
+	retryAfter time.Duration
+	dead       bool
+}
+
+type fakeDeliveryStore struct {
+	deliveries []models.WebhookDelivery
+	completed  []int64
+	failed     []failedDelivery
+}
+
+func (f *fakeDeliveryStore) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	deliveries := f.deliveries
+	f.deliveries = nil
+	return deliveries, nil
+}
+
+func (f *fakeDeliveryStore) CompleteWebhookDelivery(ctx context.Context, id int64) error {
+	f.completed = append(f.completed, id)
+	return nil
+}
+
+func (f *fakeDeliveryStore) FailWebhookDelivery(ctx context.Context, id int64, deliveryErr string, retryAfter time.Duration, dead bool) error {
+	f.failed = append(f.failed, failedDelivery{id: id, retryAfter: retryAfter, dead: dead})
+	return nil
+}
+
+func TestDeliverWebhookSignature(t *testing.T) {
+	const secret = "secret"
+	payload := []byte(`{"event":"order.processed"}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %v", err)
+		}
+		if string(body) != string(payload) {
+			t.Errorf("body = %s, want %s", body, payload)
+		}
+		if got := r.Header.Get(WebhookEventHeader); got != models.WebhookOrderProcessed {
+			t.Errorf("event header = %q", got)
+		}
+		if got := r.Header.Get(WebhookDeliveryHeader); got != "7" {
+			t.Errorf("delivery header = %q", got)
+		}
+		want := SignWebhook(secret, r.Header.Get(WebhookTimestampHeader), body)
+		if got := r.Header.Get(WebhookSignatureHeader); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	store := &fakeDeliveryStore{deliveries: []models.WebhookDelivery{
+		{ID: 7, Event: models.WebhookOrderProcessed, Payload: payload, URL: server.URL, Secret: secret},
+	}}
+	deliverWebhookBatch(context.Background(), store, server.Client())
+
+	if len(store.completed) != 1 || store.completed[0] != 7 {
+		t.Fatalf("completed = %v, want [7]", store.completed)
+	}
+	if len(store.failed) != 0 {
+		t.Fatalf("failed = %v, want none", store.failed)
+	}
+}
+
+func TestDeliverWebhookRetryAndDead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		attempts   int
+		retryAfter time.Duration
+		dead       bool
+	}{
+		{"first failure", 0, webhookBaseBackoff, false},
+		{"third failure", 2, 4 * webhookBaseBackoff, false},
+		{"last attempt", webhookMaxAttempts - 1, webhookBackoff(webhookMaxAttempts), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeDeliveryStore{deliveries: []models.WebhookDelivery{
+				{ID: 1, Event: models.WebhookOrderProcessed, Payload: []byte(`{}`), Attempts: tt.attempts, URL: server.URL, Secret: "secret"},
+			}}
+			deliverWebhookBatch(context.Background(), store, server.Client())
+
+			if len(store.completed) != 0 {
+				t.Fatalf("completed = %v, want none", store.completed)
+			}
+			want := failedDelivery{id: 1, retryAfter: tt.retryAfter, dead: tt.dead}
+			if len(store.failed) != 1 || store.failed[0] != want {
+				t.Fatalf("failed = %+v, want %+v", store.failed, want)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoffIsCapped(t *testing.T) {
+	if got := webhookBackoff(100); got != webhookMaxBackoff {
+		t.Fatalf("backoff = %s, want %s", got, webhookMaxBackoff)
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached loopback receiver")
+	}))
+	defer server.Close()
+
+	err := SendWebhook(context.Background(), webhookClient, models.WebhookDelivery{ID: 1, Payload: []byte(`{}`), URL: server.URL})
+	if !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("error = %v, want %v", err, errBlockedAddress)
+	}
+}
+
+func TestValidateWebhookRequestRejectsInternalHosts(t *testing.T) {
+	for _, url := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+		"ftp://example.com/hook",
+	} {
+		if err := validateWebhookRequest(context.Background(), models.WebhookRequest{URL: url}); err == nil {
+			t.Errorf("validateWebhookRequest(%q) accepted internal address", url)
+		}
+	}
+
+	if err := validateWebhookRequest(context.Background(), models.WebhookRequest{URL: "http://93.184.216.34/hook"}); err != nil {
+		t.Errorf("validateWebhookRequest rejected public address: %v", err)
+	}
+}